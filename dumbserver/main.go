@@ -18,17 +18,20 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
-	"crypto/tls"
+	"context"
 	"encoding/hex"
 	"fmt"
 	"html"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	vaultapi "github.com/hashicorp/vault/api"
 	"github.com/sirlatrom/tls-sidecar-playground/tlsrotater"
+	"github.com/sirlatrom/tls-sidecar-playground/tlsrotater/authz"
+	"github.com/sirlatrom/tls-sidecar-playground/tlsrotater/bootstrap"
 )
 
 func main() {
@@ -52,42 +55,51 @@ func main() {
 			}
 			fmt.Fprintf(w, "I see you are: %q with serial %q\n", cert.Subject.CommonName, prettySerial)
 		}
+		if id, ok := tlsrotater.SPIFFEIDFromContext(r.Context()); ok {
+			fmt.Fprintf(w, "Your SPIFFE ID is %q\n", id)
+		}
 		r.Close = true
 	})
 
-	client, err := vaultapi.NewClient(vaultapi.DefaultConfig())
+	sidecar, err := bootstrap.Start(context.Background(), "dumbserver")
 	if err != nil {
 		panic(err)
 	}
-	log.Println("Created Vault client")
-	if _, ok := os.LookupEnv("VAULT_TOKEN"); !ok {
-		contents, err := ioutil.ReadFile("/run/secrets/vault_token")
+	defer sidecar.Stop()
+
+	handler := tlsrotater.SPIFFEHandler(http.DefaultServeMux)
+	if v, ok := os.LookupEnv("authzPolicy"); ok {
+		policy, err := authz.Load(v)
 		if err != nil {
 			panic(err)
 		}
-		client.SetToken(string(contents))
+		handler = policy.Middleware(handler)
+		log.Printf("Authorizing clients with %v\n", v)
 	}
-	log.Println("Read vault token")
 
-	rotater := tlsrotater.NewTLSRotater(client, "dumbserver", []string{"localhost"})
-	if err := rotater.Start(); err != nil {
-		panic(err)
-	}
-	defer rotater.Stop()
-	log.Println("Created keypair reloader")
-
-	tlsConfig := tls.Config{
-		RootCAs:    rotater.CACertPool,
-		ClientCAs:  rotater.CACertPool,
-		ClientAuth: tls.RequireAndVerifyClientCert,
-	}
-	tlsConfig.GetCertificate = rotater.GetCertificateFunc()
 	srv := http.Server{
 		Addr:      ":" + listenPort,
-		TLSConfig: &tlsConfig,
+		Handler:   handler,
+		TLSConfig: sidecar.Identities.ServerTLSConfig(),
 	}
-	if err := srv.ListenAndServeTLS("", ""); err != nil {
+	// Revoking certificates when the sidecar stops requires stopping it
+	// rather than being killed, after in-flight requests have been served
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.ListenAndServeTLS("", "")
+	}()
+	select {
+	case err := <-served:
 		panic(err)
+	case <-ctx.Done():
+	}
+	log.Println("Received signal, stopping")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error while shutting down: %v\n", err)
 	}
 	log.Println("Done serving")
 }
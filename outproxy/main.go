@@ -18,20 +18,22 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
-	"crypto/tls"
+	"context"
 	"encoding/hex"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
-	vaultapi "github.com/hashicorp/vault/api"
 	"github.com/sirlatrom/tls-sidecar-playground/tlsrotater"
+	"github.com/sirlatrom/tls-sidecar-playground/tlsrotater/authz"
+	"github.com/sirlatrom/tls-sidecar-playground/tlsrotater/bootstrap"
 )
 
 var (
@@ -65,32 +67,11 @@ func main() {
 		servePort = overridePort
 	}
 
-	client, err := vaultapi.NewClient(vaultapi.DefaultConfig())
+	sidecar, err := bootstrap.Start(context.Background(), "outproxy")
 	if err != nil {
 		panic(err)
 	}
-	log.Println("Created Vault client")
-	if _, ok := os.LookupEnv("VAULT_TOKEN"); !ok {
-		contents, err := ioutil.ReadFile("/run/secrets/vault_token")
-		if err != nil {
-			panic(err)
-		}
-		client.SetToken(string(contents))
-	}
-	log.Println("Read vault token")
-
-	rotater := tlsrotater.NewTLSRotater(client, "outproxy", []string{"localhost"})
-	if err := rotater.Start(); err != nil {
-		panic(err)
-	}
-	defer rotater.Stop()
-	log.Println("Created keypair reloader")
-
-	tlsConfig := tls.Config{
-		RootCAs:              rotater.CACertPool,
-		ClientCAs:            rotater.CACertPool,
-		GetClientCertificate: rotater.GetClientCertificateFunc(),
-	}
+	defer sidecar.Stop()
 
 	reverseProxy := httputil.NewSingleHostReverseProxy(theURL)
 	reverseProxy.ModifyResponse = func(response *http.Response) error {
@@ -109,7 +90,17 @@ func main() {
 		}
 		return nil
 	}
-	reverseProxy.Transport = &http.Transport{
+	tlsConfig := sidecar.Identities.ClientTLSConfig()
+	tlsConfig.ServerName = theURL.Hostname()
+	if v, ok := os.LookupEnv("targetSPIFFEID"); ok {
+		id, err := tlsrotater.ParseSPIFFEID(v)
+		if err != nil {
+			panic(err)
+		}
+		tlsConfig = sidecar.Identities.SPIFFEClientTLSConfig(tlsrotater.MatchSPIFFEID(id))
+		log.Printf("Verifying upstreams by SPIFFE ID %v\n", id)
+	}
+	transport := &http.Transport{
 		Proxy:             http.ProxyFromEnvironment,
 		DisableKeepAlives: true,
 		Dial: (&net.Dialer{
@@ -117,12 +108,38 @@ func main() {
 			KeepAlive: 30 * time.Second,
 		}).Dial,
 		TLSHandshakeTimeout: 10 * time.Second,
-		TLSClientConfig:     &tlsConfig,
+		TLSClientConfig:     tlsConfig,
+	}
+	reverseProxy.Transport = transport
+	if v, ok := os.LookupEnv("authzPolicy"); ok {
+		policy, err := authz.Load(v)
+		if err != nil {
+			panic(err)
+		}
+		reverseProxy.Transport = &authz.Transport{Policy: policy, Base: transport}
+		log.Printf("Authorizing upstreams with %v\n", v)
 	}
 	http.HandleFunc("/", handler(reverseProxy))
-	err = http.ListenAndServe(":"+servePort, nil)
-	if err != nil {
+	srv := http.Server{Addr: ":" + servePort}
+
+	// Revoking certificates when the sidecar stops requires stopping it
+	// rather than being killed, after in-flight requests have been served
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-served:
 		panic(err)
+	case <-ctx.Done():
+	}
+	log.Println("Received signal, stopping")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error while shutting down: %v\n", err)
 	}
 	log.Println("Done serving")
 }
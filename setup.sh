@@ -14,6 +14,7 @@ docker exec -e VAULT_ADDR=http://127.0.0.1:8200 ${vault_cid} vault mount pki
 docker exec -e VAULT_ADDR=http://127.0.0.1:8200 ${vault_cid} vault write pki/root/generate/internal common_name=root
 docker exec -e VAULT_ADDR=http://127.0.0.1:8200 ${vault_cid} vault write pki/roles/dumbserver allowed_domains=localhost,dumbserver allow_bare_domains=true
 docker exec -e VAULT_ADDR=http://127.0.0.1:8200 ${vault_cid} vault write pki/roles/outproxy allowed_domains=localhost,outproxy allow_bare_domains=true
+docker exec -e VAULT_ADDR=http://127.0.0.1:8200 ${vault_cid} vault write pki/roles/tlsagent allowed_domains=localhost,tlsagent allow_bare_domains=true
 docker service scale --detach=false stack_outproxy=3 stack_dumbserver=3
 
 ## Optionally:
@@ -0,0 +1,90 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirlatrom/tls-sidecar-playground/tlsrotater"
+	"github.com/sirlatrom/tls-sidecar-playground/tlsrotater/bootstrap"
+)
+
+var reloadSignals = map[string]os.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+func main() {
+	sink := &tlsrotater.FileSink{Dir: "/certs"}
+	if v, ok := os.LookupEnv("sinkDir"); ok {
+		sink.Dir = v
+	}
+	if v, ok := os.LookupEnv("reloadSignal"); ok {
+		reloadSignal, ok := reloadSignals[strings.TrimPrefix(strings.ToUpper(v), "SIG")]
+		if !ok {
+			panic(fmt.Sprintf("Unknown reloadSignal %q", v))
+		}
+		sink.Signal = reloadSignal
+	}
+	if v, ok := os.LookupEnv("reloadPid"); ok {
+		pid, err := strconv.Atoi(v)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid reloadPid %q: %v", v, err))
+		}
+		sink.PID = pid
+	}
+	if v, ok := os.LookupEnv("reloadPidFile"); ok {
+		sink.PIDFile = v
+	}
+	if v, ok := os.LookupEnv("reloadCommand"); ok {
+		sink.Command = strings.Fields(v)
+	}
+	if v, ok := os.LookupEnv("reloadTimeout"); ok {
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout <= 0 {
+			panic(fmt.Sprintf("Invalid reloadTimeout %q, want a positive duration", v))
+		}
+		sink.CommandTimeout = timeout
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	sidecar, err := bootstrap.Start(ctx, "tlsagent", tlsrotater.WithFileSink(sink))
+	if err != nil {
+		panic(err)
+	}
+	// Let the last rotation be written after the sidecar has stopped
+	defer sink.Wait()
+	defer sidecar.Stop()
+	log.Printf("Writing certificates to %v\n", sink.Dir)
+
+	<-ctx.Done()
+	log.Println("Received signal, stopping")
+}
@@ -0,0 +1,97 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// AppRole is an Authenticator logging in with Vault's AppRole auth method.
+// The secret_id is read from a file, such as a Docker secret, on every login.
+type AppRole struct {
+	// Mount is the path the AppRole auth method is mounted at. Defaults to
+	// "approle".
+	Mount  string
+	RoleID string
+	// SecretIDFile is the file holding the secret_id.
+	SecretIDFile string
+	// Wrapped means the file holds a response-wrapping token that has to be
+	// unwrapped to get the secret_id.
+	Wrapped bool
+
+	// Wrapping tokens can only be unwrapped once, so the secret_id is kept
+	// for as long as the file holds the same wrapping token.
+	mu              sync.Mutex
+	wrappingToken   string
+	unwrappedSecret string
+}
+
+// Login implements Authenticator.
+func (approle *AppRole) Login(client *vaultapi.Client) (*vaultapi.Secret, error) {
+	contents, err := ioutil.ReadFile(approle.SecretIDFile)
+	if err != nil {
+		return nil, err
+	}
+	secretID := strings.TrimSpace(string(contents))
+	if approle.Wrapped {
+		if secretID, err = approle.unwrap(withToken(client, ""), secretID); err != nil {
+			return nil, err
+		}
+	}
+
+	mount := approle.Mount
+	if mount == "" {
+		mount = "approle"
+	}
+	params := make(map[string]interface{})
+	params["role_id"] = approle.RoleID
+	params["secret_id"] = secretID
+	secret, err := loginWith(client, mount, params)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't log in with AppRole: %v", err)
+	}
+	return secret, nil
+}
+
+// unwrap returns the secret_id wrapped by the given wrapping token.
+func (approle *AppRole) unwrap(client *vaultapi.Client, wrappingToken string) (string, error) {
+	approle.mu.Lock()
+	defer approle.mu.Unlock()
+	if wrappingToken == approle.wrappingToken {
+		return approle.unwrappedSecret, nil
+	}
+	secret, err := client.Logical().Unwrap(wrappingToken)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't unwrap secret_id: %v", err)
+	}
+	if secret == nil {
+		return "", fmt.Errorf("Couldn't unwrap secret_id: empty response")
+	}
+	secretID, ok := secret.Data["secret_id"].(string)
+	if !ok {
+		return "", fmt.Errorf("Wrapped response holds no secret_id")
+	}
+	approle.wrappingToken = wrappingToken
+	approle.unwrappedSecret = secretID
+	return secretID, nil
+}
@@ -0,0 +1,349 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+// Package authz authorizes mTLS peers by the identity in their certificate,
+// per path prefix and HTTP method, according to a policy loaded from a file.
+//
+// A policy is a JSON document like:
+//  {
+//    "default": "deny",
+//    "rules": [
+//      {"path": "/", "methods": ["GET"], "allow": [{"cn": "outproxy"}]},
+//      {"path": "/admin", "allow": [{"uri": "spiffe://example.org/ops/*"}, {"ou": "ops", "dns": "*.internal"}]}
+//    ]
+//  }
+// The rule with the longest path prefix of a request, among those
+// listing its method or no methods at all, decides. A peer is allowed if it
+// matches any of the rule's peers, and matches a peer if it matches all of its
+// fields. Fields are patterns as understood by path.Match. Requests matching
+// no rule are allowed only if the default is "allow".
+package authz
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Policy decides which peers may make which requests.
+type Policy struct {
+	// Default is "allow" or "deny", for requests matching no rule. Defaults
+	// to "deny".
+	Default string `json:"default"`
+	Rules   []Rule `json:"rules"`
+}
+
+// Rule allows peers to make requests under a path prefix.
+type Rule struct {
+	// Path is the path prefix the rule applies to.
+	Path string `json:"path"`
+	// Methods are the HTTP methods the rule applies to, or all if empty.
+	Methods []string `json:"methods"`
+	// Allow are the peers allowed.
+	Allow []Peer `json:"allow"`
+}
+
+// Peer matches peers by their certificate. At least one field must be set;
+// fields left empty match any peer, so {"cn": "*"} matches every peer.
+type Peer struct {
+	// CN matches the common name.
+	CN string `json:"cn"`
+	// DNS matches any DNS SAN.
+	DNS string `json:"dns"`
+	// URI matches any URI SAN, such as a SPIFFE ID.
+	URI string `json:"uri"`
+	// OU matches any organizational unit.
+	OU string `json:"ou"`
+}
+
+// Load reads a policy from a JSON file. Unknown fields are rejected, so that a
+// misspelt field doesn't silently widen a rule.
+func Load(filename string) (*Policy, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	policy := &Policy{}
+	if err := decoder.Decode(policy); err != nil {
+		return nil, fmt.Errorf("Couldn't parse policy %v: %v", filename, err)
+	}
+	if err := policy.validate(); err != nil {
+		return nil, fmt.Errorf("Invalid policy %v: %v", filename, err)
+	}
+	return policy, nil
+}
+
+// validate checks the default, the paths and the peers of the policy.
+func (policy *Policy) validate() error {
+	switch policy.Default {
+	case "", "allow", "deny":
+	default:
+		return fmt.Errorf("Unknown default %q", policy.Default)
+	}
+	for _, rule := range policy.Rules {
+		if !strings.HasPrefix(rule.Path, "/") {
+			return fmt.Errorf("Path %q doesn't start with /", rule.Path)
+		}
+		for _, peer := range rule.Allow {
+			if peer == (Peer{}) {
+				return fmt.Errorf("Peer allowed under %v sets no fields", rule.Path)
+			}
+			for _, pattern := range []string{peer.CN, peer.DNS, peer.URI, peer.OU} {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("Invalid pattern %q: %v", pattern, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// rule returns the rule deciding a request, or nil if none applies.
+func (policy *Policy) rule(method, requestPath string) *Rule {
+	var best *Rule
+	for i := range policy.Rules {
+		rule := &policy.Rules[i]
+		if !underPath(requestPath, rule.Path) {
+			continue
+		}
+		if len(rule.Methods) > 0 && !containsFold(rule.Methods, method) {
+			continue
+		}
+		if best == nil || len(rule.Path) > len(best.Path) {
+			best = rule
+		}
+	}
+	return best
+}
+
+// Authorize returns an error unless the peer presenting the certificate may
+// make the request.
+func (policy *Policy) Authorize(method, requestPath string, certificate *x509.Certificate) error {
+	rule := policy.rule(method, requestPath)
+	if rule == nil {
+		if policy.Default == "allow" {
+			return nil
+		}
+		return fmt.Errorf("No rule for %v %v", method, requestPath)
+	}
+	if certificate == nil {
+		return fmt.Errorf("No peer certificate for %v %v", method, requestPath)
+	}
+	if rule.allows(certificate) {
+		return nil
+	}
+	return fmt.Errorf("%q may not %v %v", certificate.Subject.CommonName, method, requestPath)
+}
+
+// Middleware returns a handler that serves requests by peers allowed by the
+// policy with next, and rejects others with 403 Forbidden.
+func (policy *Policy) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var certificate *x509.Certificate
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			certificate = r.TLS.PeerCertificates[0]
+		}
+		if err := policy.Authorize(r.Method, r.URL.Path, certificate); err != nil {
+			log.Printf("Denied request from %v: %v\n", r.RemoteAddr, err)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Transport is an http.RoundTripper that only sends requests to upstream
+// servers allowed by the policy to serve them. The upstream is authorized
+// during the TLS handshake, before any of the request has been written. Each
+// rule gets its own connections, so that a connection is never reused for a
+// request decided by another rule.
+type Transport struct {
+	Policy *Policy
+	// Base is cloned to make the requests of each rule. Defaults to
+	// http.DefaultTransport.
+	Base *http.Transport
+
+	mu         sync.Mutex
+	transports map[*Rule]*http.Transport
+}
+
+// RoundTrip implements http.RoundTripper.
+func (transport *Transport) RoundTrip(request *http.Request) (*http.Response, error) {
+	rule := transport.Policy.rule(request.Method, request.URL.Path)
+	if rule == nil || request.URL.Scheme != "https" {
+		// Without a rule, or a peer certificate to check, the policy
+		// decides before connecting
+		if err := transport.Policy.Authorize(request.Method, request.URL.Path, nil); err != nil {
+			if request.Body != nil {
+				request.Body.Close()
+			}
+			return nil, fmt.Errorf("Upstream %v not authorized: %v", request.URL.Host, err)
+		}
+	}
+	return transport.forRule(rule).RoundTrip(request)
+}
+
+// forRule returns the transport making the requests decided by the rule,
+// which only completes handshakes with upstreams the rule allows. Requests
+// decided by no rule are made with the base transport.
+func (transport *Transport) forRule(rule *Rule) *http.Transport {
+	base := transport.Base
+	if base == nil {
+		base = http.DefaultTransport.(*http.Transport)
+	}
+	if rule == nil {
+		return base
+	}
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	if ruleTransport, ok := transport.transports[rule]; ok {
+		return ruleTransport
+	}
+	authorize := func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return fmt.Errorf("Upstream presented no certificate for %v", rule.Path)
+		}
+		if certificate := state.PeerCertificates[0]; !rule.allows(certificate) {
+			return fmt.Errorf("Upstream %q isn't allowed to serve %v", certificate.Subject.CommonName, rule.Path)
+		}
+		return nil
+	}
+	ruleTransport := base.Clone()
+	dial := ruleTransport.DialTLSContext
+	if dial == nil && ruleTransport.DialTLS != nil {
+		dialTLS := ruleTransport.DialTLS
+		dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialTLS(network, addr)
+		}
+		ruleTransport.DialTLS = nil
+	}
+	if dial != nil {
+		ruleTransport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			tlsConn, ok := conn.(*tls.Conn)
+			if !ok {
+				conn.Close()
+				return nil, fmt.Errorf("Couldn't authorize upstream %v without TLS", addr)
+			}
+			if err := authorize(tlsConn.ConnectionState()); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		}
+	} else {
+		config := ruleTransport.TLSClientConfig
+		if config == nil {
+			config = &tls.Config{}
+		}
+		verifyConnection := config.VerifyConnection
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			if verifyConnection != nil {
+				if err := verifyConnection(state); err != nil {
+					return err
+				}
+			}
+			return authorize(state)
+		}
+		ruleTransport.TLSClientConfig = config
+	}
+	if transport.transports == nil {
+		transport.transports = make(map[*Rule]*http.Transport)
+	}
+	transport.transports[rule] = ruleTransport
+	return ruleTransport
+}
+
+// allows reports whether the certificate matches any of the peers of the
+// rule.
+func (rule *Rule) allows(certificate *x509.Certificate) bool {
+	for _, peer := range rule.Allow {
+		if peer.matches(certificate) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether the certificate matches all fields of the peer.
+func (peer Peer) matches(certificate *x509.Certificate) bool {
+	if peer.CN != "" && !match(peer.CN, certificate.Subject.CommonName) {
+		return false
+	}
+	if peer.DNS != "" && !matchAny(peer.DNS, certificate.DNSNames) {
+		return false
+	}
+	if peer.URI != "" {
+		var uris []string
+		for _, uri := range certificate.URIs {
+			uris = append(uris, uri.String())
+		}
+		if !matchAny(peer.URI, uris) {
+			return false
+		}
+	}
+	if peer.OU != "" && !matchAny(peer.OU, certificate.Subject.OrganizationalUnit) {
+		return false
+	}
+	return true
+}
+
+func match(pattern, value string) bool {
+	matched, _ := path.Match(pattern, value)
+	return matched
+}
+
+func matchAny(pattern string, values []string) bool {
+	for _, value := range values {
+		if match(pattern, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// underPath reports whether a request path is the prefix or below it.
+func underPath(requestPath, prefix string) bool {
+	if strings.HasSuffix(prefix, "/") {
+		return strings.HasPrefix(requestPath, prefix)
+	}
+	return requestPath == prefix || strings.HasPrefix(requestPath, prefix+"/")
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,212 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package authz
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// writePolicy writes a policy file and returns its name.
+func writePolicy(t *testing.T, contents string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "policy.json")
+	if err := ioutil.WriteFile(filename, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		wantErr string
+	}{
+		{"valid", `{"default": "deny", "rules": [{"path": "/", "allow": [{"cn": "ops"}, {"uri": "spiffe://example.org/*"}]}]}`, ""},
+		{"any peer", `{"rules": [{"path": "/", "allow": [{"cn": "*"}]}]}`, ""},
+		{"misspelt peer field", `{"rules": [{"path": "/", "allow": [{"commonName": "ops"}]}]}`, "unknown field"},
+		{"misspelt rule field", `{"rules": [{"path": "/", "method": ["GET"], "allow": [{"cn": "ops"}]}]}`, "unknown field"},
+		{"misspelt policy field", `{"defualt": "allow"}`, "unknown field"},
+		{"empty peer", `{"rules": [{"path": "/", "allow": [{}]}]}`, "sets no fields"},
+		{"unknown default", `{"default": "maybe"}`, "Unknown default"},
+		{"relative path", `{"rules": [{"path": "admin", "allow": [{"cn": "ops"}]}]}`, "doesn't start with /"},
+		{"invalid pattern", `{"rules": [{"path": "/", "allow": [{"cn": "[ops"}]}]}`, "Invalid pattern"},
+		{"malformed", `{"rules": [`, "Couldn't parse"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Load(writePolicy(t, test.policy))
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("Load returned %v, want an error containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	policy, err := Load(writePolicy(t, `{
+		"default": "deny",
+		"rules": [
+			{"path": "/", "methods": ["GET"], "allow": [{"cn": "outproxy"}]},
+			{"path": "/admin", "allow": [{"uri": "spiffe://example.org/ops/*"}, {"ou": "ops", "dns": "*.internal"}]},
+			{"path": "/public/", "allow": [{"cn": "*"}]}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opsURI, _ := url.Parse("spiffe://example.org/ops/alice")
+	outproxy := &x509.Certificate{Subject: pkix.Name{CommonName: "outproxy"}}
+	spiffe := &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}, URIs: []*url.URL{opsURI}}
+	ops := &x509.Certificate{Subject: pkix.Name{CommonName: "bob", OrganizationalUnit: []string{"ops"}}, DNSNames: []string{"bob.internal"}}
+	opsElsewhere := &x509.Certificate{Subject: pkix.Name{CommonName: "carol", OrganizationalUnit: []string{"ops"}}, DNSNames: []string{"carol.example.org"}}
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		certificate *x509.Certificate
+		allowed     bool
+	}{
+		{"method allowed", "GET", "/status", outproxy, true},
+		{"method not listed", "POST", "/status", outproxy, false},
+		{"longer prefix decides", "GET", "/admin/users", outproxy, false},
+		{"SPIFFE ID", "POST", "/admin", spiffe, true},
+		{"all fields", "GET", "/admin/users", ops, true},
+		{"some fields", "GET", "/admin/users", opsElsewhere, false},
+		{"not a path prefix", "POST", "/administrator", spiffe, false},
+		{"any peer", "PUT", "/public/file", opsElsewhere, true},
+		{"no certificate", "GET", "/status", nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := policy.Authorize(test.method, test.path, test.certificate)
+			if allowed := err == nil; allowed != test.allowed {
+				t.Errorf("Allowed %v, want %v (%v)", allowed, test.allowed, err)
+			}
+		})
+	}
+}
+
+func TestTransport(t *testing.T) {
+	// The certificate of httptest servers is for example.com
+	policy, err := Load(writePolicy(t, `{
+		"default": "deny",
+		"rules": [
+			{"path": "/", "methods": ["GET"], "allow": [{"dns": "example.com"}]},
+			{"path": "/admin", "allow": [{"cn": "ops"}]}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received int32
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&received, 1)
+	}))
+	defer upstream.Close()
+	config := upstream.Client().Transport.(*http.Transport).TLSClientConfig
+	bases := map[string]func() *http.Transport{
+		"TLS config": func() *http.Transport {
+			return &http.Transport{TLSClientConfig: config.Clone()}
+		},
+		"TLS dialer": func() *http.Transport {
+			return &http.Transport{DialTLSContext: (&tls.Dialer{Config: config.Clone()}).DialContext}
+		},
+	}
+	// The requests are made in order through the same transport, so that
+	// refused requests would reuse the connections of allowed ones
+	requests := []struct {
+		method  string
+		path    string
+		allowed bool
+	}{
+		{"GET", "/status", true},
+		{"POST", "/admin/users", false},
+		{"DELETE", "/status", false},
+		{"GET", "/admin", false},
+		{"GET", "/status", true},
+	}
+	for name, base := range bases {
+		t.Run(name, func(t *testing.T) {
+			transport := &Transport{Policy: policy, Base: base()}
+			defer transport.Base.CloseIdleConnections()
+			for _, test := range requests {
+				atomic.StoreInt32(&received, 0)
+				request, err := http.NewRequest(test.method, upstream.URL+test.path, strings.NewReader("body"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				response, err := transport.RoundTrip(request)
+				if err == nil {
+					response.Body.Close()
+				}
+				if allowed := err == nil; allowed != test.allowed {
+					t.Errorf("%v %v allowed %v, want %v (%v)", test.method, test.path, allowed, test.allowed, err)
+				}
+				if got := atomic.LoadInt32(&received) == 1; got != test.allowed {
+					t.Errorf("%v %v received by the upstream: %v, want %v", test.method, test.path, got, test.allowed)
+				}
+			}
+		})
+	}
+}
+
+func TestTransportWithoutTLS(t *testing.T) {
+	policy, err := Load(writePolicy(t, `{"rules": [{"path": "/", "allow": [{"cn": "*"}]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&received, 1)
+	}))
+	defer upstream.Close()
+	dialed := false
+	base := &http.Transport{DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = true
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}}
+	request, err := http.NewRequest("POST", upstream.URL+"/", strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&Transport{Policy: policy, Base: base}).RoundTrip(request); err == nil {
+		t.Error("Sent a request to an upstream without a certificate to authorize")
+	}
+	if dialed || atomic.LoadInt32(&received) != 0 {
+		t.Error("Connected to an upstream without a certificate to authorize")
+	}
+}
@@ -0,0 +1,62 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff is the retry policy for failed refreshes.
+type Backoff struct {
+	// Initial is the delay before the first retry.
+	Initial time.Duration
+	// Max caps the delay between retries.
+	Max time.Duration
+	// Multiplier is applied to the delay after each failed attempt.
+	Multiplier float64
+	// Jitter is the fraction of the delay that is randomly subtracted from it.
+	Jitter float64
+	// MaxElapsed is how long Start keeps retrying the first issuance before
+	// giving up. Zero means forever. Once started, the rotater never gives up.
+	MaxElapsed time.Duration
+}
+
+// DefaultBackoff is the retry policy used unless WithBackoff is given.
+var DefaultBackoff = Backoff{
+	Initial:    time.Second,
+	Max:        time.Minute,
+	Multiplier: 2,
+	Jitter:     0.2,
+	MaxElapsed: 2 * time.Minute,
+}
+
+// delay returns how long to wait after the given number of consecutive
+// failed attempts.
+func (backoff Backoff) delay(failures int) time.Duration {
+	delay := float64(backoff.Initial) * math.Pow(backoff.Multiplier, float64(failures-1))
+	if delay > float64(backoff.Max) {
+		delay = float64(backoff.Max)
+	}
+	delay -= delay * backoff.Jitter * rand.Float64()
+	if delay < float64(minRefreshInterval) {
+		delay = float64(minRefreshInterval)
+	}
+	return time.Duration(delay)
+}
@@ -0,0 +1,243 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+// Package bootstrap sets up Vault authentication and certificate rotation for
+// the sidecars from their environment.
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/sirlatrom/tls-sidecar-playground/tlsrotater"
+)
+
+// Sidecar holds everything started by Start.
+type Sidecar struct {
+	// Client is the Vault client whose token TokenSource keeps valid; make
+	// requests through TokenSource.Client.
+	Client      *vaultapi.Client
+	TokenSource *tlsrotater.TokenSource
+	Issuer      *tlsrotater.VaultIssuer
+	Rotater     *tlsrotater.TLSRotater
+	Tidier      *tlsrotater.VaultTidier
+	// Extra holds the rotaters of the identities besides the main one.
+	Extra []*tlsrotater.TLSRotater
+	// Identities selects between the main and extra identities.
+	Identities *tlsrotater.Identities
+	// Metrics covers all identities, if metricsAddr is set.
+	Metrics *tlsrotater.Metrics
+
+	metrics *http.Server
+}
+
+// Start logs in to Vault and starts rotating a certificate for the given
+// common name, unless overridden by the commonName environment variable, until
+// the context is cancelled or Stop is called. The given options are applied
+// after those read from the environment.
+func Start(ctx context.Context, commonName string, options ...tlsrotater.Option) (*Sidecar, error) {
+	sidecar := &Sidecar{}
+	client, err := vaultapi.NewClient(vaultapi.DefaultConfig())
+	if err != nil {
+		return nil, err
+	}
+	sidecar.Client = client
+	log.Println("Created Vault client")
+
+	auth, err := Authenticator()
+	if err != nil {
+		return nil, err
+	}
+	sidecar.TokenSource = tlsrotater.NewTokenSource(client, auth)
+	if err := sidecar.TokenSource.Start(ctx); err != nil {
+		return nil, err
+	}
+	log.Println("Read vault token")
+
+	if v, ok := os.LookupEnv("commonName"); ok {
+		commonName = v
+	}
+	rotaterOptions, err := rotaterOptionsFromEnv(nil)
+	if err != nil {
+		sidecar.Stop()
+		return nil, err
+	}
+	spiffeOptions, err := spiffeOptionsFromEnv(commonName)
+	if err != nil {
+		sidecar.Stop()
+		return nil, err
+	}
+	rotaterOptions = append(rotaterOptions, spiffeOptions...)
+	rotaterOptions = append(rotaterOptions, tlsrotater.WithTokenSource(sidecar.TokenSource))
+	rotaterOptions = append(rotaterOptions, options...)
+	vaultOptions := append(vaultOptionsFromEnv(), tlsrotater.WithClientSource(sidecar.TokenSource.Client))
+	sidecar.Issuer = tlsrotater.NewVaultIssuer(client, vaultOptions...)
+	rotater := tlsrotater.NewTLSRotater(sidecar.Issuer, commonName, rotaterOptions...)
+	if addr, ok := os.LookupEnv("metricsAddr"); ok {
+		mux := http.NewServeMux()
+		sidecar.Metrics = tlsrotater.NewMetrics(rotater)
+		mux.Handle("/metrics", sidecar.Metrics)
+		sidecar.metrics = &http.Server{Addr: addr, Handler: mux}
+		go func(metrics *http.Server) {
+			if err := metrics.ListenAndServe(); err != http.ErrServerClosed {
+				fmt.Fprintf(os.Stderr, "Error while serving metrics: %v\n", err)
+			}
+		}(sidecar.metrics)
+		log.Printf("Serving metrics on %v/metrics\n", addr)
+	}
+	if err := rotater.Start(ctx); err != nil {
+		sidecar.Stop()
+		return nil, err
+	}
+	sidecar.Rotater = rotater
+	log.Println("Created keypair reloader")
+
+	for _, extra := range identitiesFromEnv() {
+		extra := extra
+		extraOptions, err := rotaterOptionsFromEnv(&extra)
+		if err != nil {
+			sidecar.Stop()
+			return nil, err
+		}
+		spiffeOptions, err := spiffeOptionsFromEnv(extra.commonName)
+		if err != nil {
+			sidecar.Stop()
+			return nil, err
+		}
+		extraOptions = append(extraOptions, spiffeOptions...)
+		extraOptions = append(extraOptions, tlsrotater.WithTokenSource(sidecar.TokenSource))
+		vaultOptions := append(vaultOptionsFromEnv(), tlsrotater.WithClientSource(sidecar.TokenSource.Client), tlsrotater.WithRole(extra.role))
+		if extra.mount != "" {
+			vaultOptions = append(vaultOptions, tlsrotater.WithMount(extra.mount))
+		}
+		issuer := tlsrotater.NewVaultIssuer(client, vaultOptions...)
+		extraRotater := tlsrotater.NewTLSRotater(issuer, extra.commonName, extraOptions...)
+		if sidecar.Metrics != nil {
+			sidecar.Metrics.Register(extraRotater)
+		}
+		if err := extraRotater.Start(ctx); err != nil {
+			sidecar.Stop()
+			return nil, fmt.Errorf("Couldn't start identity %v: %v", extra.commonName, err)
+		}
+		sidecar.Extra = append(sidecar.Extra, extraRotater)
+		log.Printf("Created keypair reloader for %v\n", extra.commonName)
+	}
+	sidecar.Identities = tlsrotater.NewIdentities(rotater, sidecar.Extra...)
+
+	if v, ok := os.LookupEnv("tidyInterval"); ok {
+		interval, err := parseInterval("tidyInterval", v)
+		if err != nil {
+			sidecar.Stop()
+			return nil, err
+		}
+		tidyLock := "secret/data/tlsrotater/tidy-lock"
+		if v, ok := os.LookupEnv("tidyLock"); ok {
+			tidyLock = v
+		}
+		sidecar.Tidier = tlsrotater.NewVaultTidier(sidecar.Issuer, tlsrotater.WithTidyInterval(interval), tlsrotater.WithTidyLock(tidyLock))
+		if err := sidecar.Tidier.Start(); err != nil {
+			sidecar.Stop()
+			return nil, err
+		}
+		log.Println("Started PKI tidier")
+	}
+	return sidecar, nil
+}
+
+// Stop stops everything started by Start, and waits for it to stop.
+func (sidecar *Sidecar) Stop() {
+	if sidecar.metrics != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := sidecar.metrics.Shutdown(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "Error while stopping metrics: %v\n", err)
+		}
+	}
+	if sidecar.Tidier != nil {
+		sidecar.Tidier.Stop()
+	}
+	for _, rotater := range sidecar.Extra {
+		rotater.Stop()
+	}
+	if sidecar.Rotater != nil {
+		sidecar.Rotater.Stop()
+	}
+	if sidecar.TokenSource != nil {
+		sidecar.TokenSource.Stop()
+	}
+}
+
+// Authenticator returns how to log in to Vault: with AppRole if VAULT_ROLE_ID
+// is set, with the Kubernetes service account if VAULT_K8S_ROLE is set, with
+// the token in VAULT_TOKEN if that is set, and otherwise with the token in the
+// vault_token Docker secret.
+//
+// AppRole reads its secret_id from VAULT_SECRET_ID_FILE, by default the
+// vault_secret_id Docker secret. If VAULT_SECRET_ID_WRAPPED is true, the file
+// holds a response-wrapping token for the secret_id instead. The auth method
+// is expected at VAULT_APPROLE_MOUNT, by default "approle".
+//
+// Kubernetes reads the service account token from VAULT_K8S_TOKEN_FILE, by
+// default the one mounted into the pod, and expects the auth method at
+// VAULT_K8S_MOUNT, by default "kubernetes".
+func Authenticator() (tlsrotater.Authenticator, error) {
+	if roleID, ok := os.LookupEnv("VAULT_ROLE_ID"); ok {
+		approle := &tlsrotater.AppRole{
+			Mount:        "approle",
+			RoleID:       roleID,
+			SecretIDFile: "/run/secrets/vault_secret_id",
+		}
+		if v, ok := os.LookupEnv("VAULT_APPROLE_MOUNT"); ok {
+			approle.Mount = v
+		}
+		if v, ok := os.LookupEnv("VAULT_SECRET_ID_FILE"); ok {
+			approle.SecretIDFile = v
+		}
+		if v, ok := os.LookupEnv("VAULT_SECRET_ID_WRAPPED"); ok {
+			wrapped, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid VAULT_SECRET_ID_WRAPPED %q: %v", v, err)
+			}
+			approle.Wrapped = wrapped
+		}
+		return approle, nil
+	}
+	if role, ok := os.LookupEnv("VAULT_K8S_ROLE"); ok {
+		kubernetes := &tlsrotater.Kubernetes{
+			Mount:     "kubernetes",
+			Role:      role,
+			TokenFile: tlsrotater.DefaultServiceAccountTokenFile,
+		}
+		if v, ok := os.LookupEnv("VAULT_K8S_MOUNT"); ok {
+			kubernetes.Mount = v
+		}
+		if v, ok := os.LookupEnv("VAULT_K8S_TOKEN_FILE"); ok {
+			kubernetes.TokenFile = v
+		}
+		return kubernetes, nil
+	}
+	if token, ok := os.LookupEnv("VAULT_TOKEN"); ok {
+		return tlsrotater.StaticToken(token), nil
+	}
+	return tlsrotater.TokenFile("/run/secrets/vault_token"), nil
+}
@@ -0,0 +1,114 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package bootstrap
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirlatrom/tls-sidecar-playground/tlsrotater/vaulttest"
+)
+
+// checkStopped fails the test unless the goroutines of the sidecar have
+// returned and the metrics address can be listened on again.
+func checkStopped(t *testing.T, metricsAddr string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	buf := make([]byte, 1<<20)
+	for _, function := range []string{"tlsrotater.(*TLSRotater).run", "tlsrotater.(*TokenSource).run", "bootstrap.Start.func"} {
+		for strings.Contains(string(buf[:runtime.Stack(buf, true)]), function) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Goroutine running %v leaked", function)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	listener, err := net.Listen("tcp", metricsAddr)
+	if err != nil {
+		t.Fatalf("Metrics address still in use: %v", err)
+	}
+	listener.Close()
+}
+
+// freeAddr returns a local address nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func TestStop(t *testing.T) {
+	tests := []struct {
+		name      string
+		fault     vaulttest.Fault
+		cancelled bool
+		wantErr   bool
+	}{
+		{"stopped", vaulttest.Fault{}, false, false},
+		{"failed to start", vaulttest.Fault{Status: http.StatusServiceUnavailable}, true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := vaulttest.NewServer()
+			defer server.Close()
+			server.Inject(vaulttest.EndpointIssue, test.fault)
+			metricsAddr := freeAddr(t)
+			t.Setenv("VAULT_ADDR", server.URL)
+			t.Setenv("VAULT_TOKEN", vaulttest.Token)
+			t.Setenv("metricsAddr", metricsAddr)
+			t.Setenv("identities", "extra")
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if test.cancelled {
+				cancel()
+			}
+			sidecar, err := Start(ctx, "test")
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Start returned %v, want error %v", err, test.wantErr)
+			}
+			if err == nil {
+				response, err := http.Get("http://" + metricsAddr + "/metrics")
+				if err != nil {
+					t.Fatal(err)
+				}
+				exposition, err := ioutil.ReadAll(response.Body)
+				response.Body.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, identity := range []string{"test", "extra"} {
+					if !strings.Contains(string(exposition), `tlsrotater_rotations_total{identity="`+identity+`"} 1`) {
+						t.Errorf("No rotation of %v in the metrics:\n%s", identity, exposition)
+					}
+				}
+				sidecar.Stop()
+			}
+			checkStopped(t, metricsAddr)
+		})
+	}
+}
@@ -0,0 +1,240 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package bootstrap
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirlatrom/tls-sidecar-playground/tlsrotater"
+)
+
+// rotaterOptionsFromEnv returns the options of the rotater of the main
+// identity if extra is nil, or else of the given extra identity. The
+// certificate of an extra identity has no SANs configured beyond its common
+// name, and is cached in a subdirectory named after its mount and common name.
+func rotaterOptionsFromEnv(extra *identity) ([]tlsrotater.Option, error) {
+	altNames := "localhost"
+	if v, ok := os.LookupEnv("altNames"); ok {
+		altNames = v
+	}
+	options := []tlsrotater.Option{tlsrotater.WithDNSNames(splitList(altNames)...)}
+	if v, ok := os.LookupEnv("ipSans"); ok {
+		var ips []net.IP
+		for _, s := range splitList(v) {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid IP SAN %q", s)
+			}
+			ips = append(ips, ip)
+		}
+		options = append(options, tlsrotater.WithIPAddresses(ips...))
+	}
+	if v, ok := os.LookupEnv("uriSans"); ok {
+		var uris []*url.URL
+		for _, s := range splitList(v) {
+			uri, err := url.Parse(s)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid URI SAN %q: %v", s, err)
+			}
+			uris = append(uris, uri)
+		}
+		options = append(options, tlsrotater.WithURIs(uris...))
+	}
+	if v, ok := os.LookupEnv("certTTL"); ok {
+		ttl, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid certTTL %q: %v", v, err)
+		}
+		options = append(options, tlsrotater.WithTTL(ttl))
+	}
+	if v, ok := os.LookupEnv("excludeCNFromSans"); ok {
+		exclude, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid excludeCNFromSans %q: %v", v, err)
+		}
+		options = append(options, tlsrotater.WithExcludeCNFromSANs(exclude))
+	}
+	if v, ok := os.LookupEnv("trustRefreshInterval"); ok {
+		interval, err := parseInterval("trustRefreshInterval", v)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, tlsrotater.WithTrustRefreshInterval(interval))
+	}
+	if v, ok := os.LookupEnv("tlsProfile"); ok {
+		profile, err := tlsrotater.ParseSecurityProfile(v)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, tlsrotater.WithSecurityProfile(profile))
+	}
+	if v, ok := os.LookupEnv("keyType"); ok {
+		keyType, err := tlsrotater.ParseKeyType(v)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, tlsrotater.WithKeyType(keyType))
+	}
+	if v, ok := os.LookupEnv("revocationPolicy"); ok {
+		policy, err := tlsrotater.ParseRevocationPolicy(v)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, tlsrotater.WithRevocationPolicy(policy))
+	}
+	if v, ok := os.LookupEnv("revocationGrace"); ok {
+		grace, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid revocationGrace %q: %v", v, err)
+		}
+		options = append(options, tlsrotater.WithRevocationGrace(grace))
+	}
+	if v, ok := os.LookupEnv("revokeOnStop"); ok {
+		revoke, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid revokeOnStop %q: %v", v, err)
+		}
+		options = append(options, tlsrotater.WithRevokeOnStop(revoke))
+	}
+	if v, ok := os.LookupEnv("ocspStapling"); ok {
+		stapling, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid ocspStapling %q: %v", v, err)
+		}
+		if stapling {
+			options = append(options, tlsrotater.WithOCSPStapling(os.Getenv("ocspResponder")))
+		}
+	}
+	if v, ok := os.LookupEnv("crlPolicy"); ok {
+		policy, err := tlsrotater.ParseCRLPolicy(v)
+		if err != nil {
+			return nil, err
+		}
+		interval := 5 * time.Minute
+		if v, ok := os.LookupEnv("crlInterval"); ok {
+			if interval, err = parseInterval("crlInterval", v); err != nil {
+				return nil, err
+			}
+		}
+		options = append(options, tlsrotater.WithCRLChecking(interval, policy))
+		if v, ok := os.LookupEnv("crlMaxStaleness"); ok {
+			maxStaleness, err := time.ParseDuration(v)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid crlMaxStaleness %q: %v", v, err)
+			}
+			options = append(options, tlsrotater.WithCRLMaxStaleness(maxStaleness))
+		}
+	}
+	if v, ok := os.LookupEnv("certCache"); ok {
+		minValidity := time.Minute
+		if v, ok := os.LookupEnv("certCacheMinValidity"); ok {
+			var err error
+			if minValidity, err = time.ParseDuration(v); err != nil {
+				return nil, fmt.Errorf("Invalid certCacheMinValidity %q: %v", v, err)
+			}
+		}
+		dir := v
+		if extra != nil {
+			dir = filepath.Join(v, extra.mount, extra.commonName)
+		}
+		options = append(options, tlsrotater.WithCache(dir, minValidity))
+	}
+	if extra != nil {
+		options = append(options, tlsrotater.WithDNSNames(), tlsrotater.WithIPAddresses(), tlsrotater.WithURIs())
+	}
+	return options, nil
+}
+
+// parseInterval parses the duration of the named variable, which has to be
+// positive as it sets how often something is done.
+func parseInterval(name, v string) (time.Duration, error) {
+	interval, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %v %q: %v", name, v, err)
+	}
+	if interval <= 0 {
+		return 0, fmt.Errorf("Invalid %v %q: must be positive", name, v)
+	}
+	return interval, nil
+}
+
+// spiffeOptionsFromEnv returns the option requesting the SPIFFE ID of the
+// given common name in the trust domain set by spiffeTrustDomain, if any.
+func spiffeOptionsFromEnv(commonName string) ([]tlsrotater.Option, error) {
+	trustDomain, ok := os.LookupEnv("spiffeTrustDomain")
+	if !ok {
+		return nil, nil
+	}
+	id, err := tlsrotater.ParseSPIFFEID("spiffe://" + trustDomain + "/" + commonName)
+	if err != nil {
+		return nil, err
+	}
+	return []tlsrotater.Option{tlsrotater.WithSPIFFEID(id)}, nil
+}
+
+// identity is an identity served besides the main one.
+type identity struct {
+	commonName string
+	role       string
+	mount      string
+}
+
+// identitiesFromEnv returns the identities besides the main one, given as
+// commonName, commonName=role or commonName=role@mount.
+func identitiesFromEnv() []identity {
+	var identities []identity
+	for _, v := range splitList(os.Getenv("identities")) {
+		extra := identity{commonName: v, role: v}
+		if i := strings.IndexByte(v, '='); i >= 0 {
+			extra.commonName, extra.role = v[:i], v[i+1:]
+		}
+		if i := strings.LastIndexByte(extra.role, '@'); i >= 0 {
+			extra.role, extra.mount = extra.role[:i], extra.role[i+1:]
+		}
+		identities = append(identities, extra)
+	}
+	return identities
+}
+
+func vaultOptionsFromEnv() []tlsrotater.VaultOption {
+	var options []tlsrotater.VaultOption
+	if v, ok := os.LookupEnv("pkiMount"); ok {
+		options = append(options, tlsrotater.WithMount(v))
+	}
+	if v, ok := os.LookupEnv("pkiRole"); ok {
+		options = append(options, tlsrotater.WithRole(v))
+	}
+	return options
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
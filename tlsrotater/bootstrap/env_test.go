@@ -0,0 +1,66 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package bootstrap
+
+import (
+	"testing"
+)
+
+func TestRotaterOptionsRejectNonPositiveIntervals(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		valid bool
+	}{
+		{"trust refresh interval", map[string]string{"trustRefreshInterval": "1m"}, true},
+		{"zero trust refresh interval", map[string]string{"trustRefreshInterval": "0s"}, false},
+		{"negative trust refresh interval", map[string]string{"trustRefreshInterval": "-1m"}, false},
+		{"CRL interval", map[string]string{"crlPolicy": "open", "crlInterval": "1m"}, true},
+		{"zero CRL interval", map[string]string{"crlPolicy": "open", "crlInterval": "0"}, false},
+		{"negative CRL interval", map[string]string{"crlPolicy": "closed", "crlInterval": "-5m"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			_, err := rotaterOptionsFromEnv(nil)
+			if (err == nil) != test.valid {
+				t.Errorf("rotaterOptionsFromEnv returned %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestParseInterval(t *testing.T) {
+	tests := []struct {
+		value string
+		valid bool
+	}{
+		{"1h", true},
+		{"1ns", true},
+		{"0s", false},
+		{"-1m", false},
+		{"hourly", false},
+	}
+	for _, test := range tests {
+		if _, err := parseInterval("tidyInterval", test.value); (err == nil) != test.valid {
+			t.Errorf("parseInterval(%q) returned %v, want valid %v", test.value, err, test.valid)
+		}
+	}
+}
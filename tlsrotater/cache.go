@@ -0,0 +1,268 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Files of the on-disk cache of the issued identity.
+const (
+	cacheCertFile   = "cert.pem"
+	cacheKeyFile    = "key.pem"
+	cacheChainFile  = "chain.pem"
+	cacheSerialFile = "serial"
+)
+
+// saveCache writes the certificate to the cache directory, if one is
+// configured. The private key is only readable by the owner.
+func (rotater *TLSRotater) saveCache(certificate *Certificate) error {
+	if rotater.cacheDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(rotater.cacheDir, 0700); err != nil {
+		return err
+	}
+	certPEM, keyPEM, err := encodeKeypair(certificate.Keypair)
+	if err != nil {
+		return err
+	}
+	files := []struct {
+		name     string
+		contents []byte
+		perm     os.FileMode
+	}{
+		{cacheCertFile, certPEM, 0644},
+		{cacheKeyFile, keyPEM, 0600},
+		{cacheChainFile, certificate.CAChain, 0644},
+		{cacheSerialFile, []byte(certificate.Serial + "\n"), 0644},
+	}
+	for _, file := range files {
+		if err := writeFileAtomic(filepath.Join(rotater.cacheDir, file.name), file.contents, file.perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadCache returns the cached certificate if it was issued as currently
+// requested and stays valid for longer than the minimum validity.
+func (rotater *TLSRotater) loadCache() (*Certificate, error) {
+	read := func(name string) ([]byte, error) {
+		return ioutil.ReadFile(filepath.Join(rotater.cacheDir, name))
+	}
+	certPEM, err := read(cacheCertFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := read(cacheKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	chainPEM, err := read(cacheChainFile)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := read(cacheSerialFile)
+	if err != nil {
+		return nil, err
+	}
+	keypair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if keypair.Leaf == nil {
+		if keypair.Leaf, err = x509.ParseCertificate(keypair.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	if err := rotater.matchesRequest(keypair.Leaf); err != nil {
+		return nil, err
+	}
+	if remaining := time.Until(keypair.Leaf.NotAfter); remaining < rotater.cacheMinValidity {
+		return nil, fmt.Errorf("Cached certificate is only valid for %v", remaining)
+	}
+	return &Certificate{
+		Keypair: &keypair,
+		Serial:  strings.TrimSpace(string(serial)),
+		CAChain: chainPEM,
+	}, nil
+}
+
+// restoreCache starts serving the cached certificate, if there is a usable
+// one, and reports whether it did.
+func (rotater *TLSRotater) restoreCache() bool {
+	if rotater.cacheDir == "" {
+		return false
+	}
+	certificate, err := rotater.loadCache()
+	if err != nil {
+		log.Printf("Not using cached certificate: %v\n", err)
+		return false
+	}
+	trustBundle, err := rotater.issuer.TrustBundle()
+	if err != nil {
+		log.Printf("Couldn't fetch trust bundle, trusting the cached chain: %v\n", err)
+		trustBundle = certificate.CAChain
+	}
+	if err := rotater.trust.update(trustBundle); err != nil {
+		log.Printf("Not using cached certificate: %v\n", err)
+		return false
+	}
+	if err := rotater.verifyCached(certificate); err != nil {
+		log.Printf("Not using cached certificate: %v\n", err)
+		return false
+	}
+	rotater.current.Store(certificate)
+	rotater.rotated(certificate, nil, 0)
+	log.Printf("Using cached certificate. Serial: %v, valid until %v\n", certificate.Serial, certificate.Keypair.Leaf.NotAfter)
+	return true
+}
+
+// matchesRequest checks that a cached certificate has the common name, SANs
+// and key type currently requested.
+func (rotater *TLSRotater) matchesRequest(leaf *x509.Certificate) error {
+	request := rotater.request
+	if leaf.Subject.CommonName != request.CommonName {
+		return fmt.Errorf("Cached certificate is for %q", leaf.Subject.CommonName)
+	}
+	// The issuer may add the common name to the DNS SANs
+	if !sameNames(leaf.DNSNames, request.DNSNames, request.CommonName) {
+		return fmt.Errorf("Cached certificate has DNS SANs %v, want %v", leaf.DNSNames, request.DNSNames)
+	}
+	var ips, wantIPs []string
+	for _, ip := range leaf.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	for _, ip := range request.IPAddresses {
+		wantIPs = append(wantIPs, ip.String())
+	}
+	if !sameNames(ips, wantIPs, "") {
+		return fmt.Errorf("Cached certificate has IP SANs %v, want %v", ips, wantIPs)
+	}
+	var uris, wantURIs []string
+	for _, uri := range leaf.URIs {
+		uris = append(uris, uri.String())
+	}
+	for _, uri := range request.URIs {
+		wantURIs = append(wantURIs, uri.String())
+	}
+	if !sameNames(uris, wantURIs, "") {
+		return fmt.Errorf("Cached certificate has URI SANs %v, want %v", uris, wantURIs)
+	}
+	if rotater.keyType != KeyIssuerGenerated {
+		if keyType := keyTypeOf(leaf.PublicKey); keyType != rotater.keyType {
+			return fmt.Errorf("Cached certificate has a %v key, want %v", keyType, rotater.keyType)
+		}
+	}
+	return nil
+}
+
+// sameNames reports whether two lists hold the same names, ignoring order,
+// duplicates and whether optional is in them.
+func sameNames(names, want []string, optional string) bool {
+	set := func(names []string) []string {
+		seen := make(map[string]bool)
+		var unique []string
+		for _, name := range names {
+			if name != optional && !seen[name] {
+				seen[name] = true
+				unique = append(unique, name)
+			}
+		}
+		sort.Strings(unique)
+		return unique
+	}
+	return strings.Join(set(names), ",") == strings.Join(set(want), ",")
+}
+
+// verifyCached checks that a cached certificate chains to the current trust
+// bundle.
+func (rotater *TLSRotater) verifyCached(certificate *Certificate) error {
+	options := x509.VerifyOptions{
+		Roots:         rotater.trust.Pool(),
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	options.Intermediates.AppendCertsFromPEM(certificate.CAChain)
+	if _, err := certificate.Keypair.Leaf.Verify(options); err != nil {
+		return fmt.Errorf("Cached certificate isn't trusted: %v", err)
+	}
+	return nil
+}
+
+// removeCache removes the cached certificate, if a cache is configured, so
+// that a revoked certificate is not picked up again.
+func (rotater *TLSRotater) removeCache() error {
+	if rotater.cacheDir == "" {
+		return nil
+	}
+	for _, name := range []string{cacheCertFile, cacheKeyFile, cacheChainFile, cacheSerialFile} {
+		if err := os.Remove(filepath.Join(rotater.cacheDir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeKeypair returns the PEM encoded certificate chain and private key of
+// a keypair.
+func encodeKeypair(keypair *tls.Certificate) ([]byte, []byte, error) {
+	var certPEM []byte
+	for _, der := range keypair.Certificate {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(keypair.PrivateKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Couldn't marshal private key: %v", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// writeFileAtomic writes a file by writing a temporary file next to it and
+// renaming it into place, so readers never see a partially written file.
+func writeFileAtomic(path string, contents []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
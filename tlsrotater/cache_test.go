@@ -0,0 +1,71 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sirlatrom/tls-sidecar-playground/tlsrotater/vaulttest"
+)
+
+func TestCache(t *testing.T) {
+	spiffeID, err := ParseSPIFFEID("spiffe://example.org/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		cached   []Option
+		options  []Option
+		rotateCA bool
+		reused   bool
+	}{
+		{"same request", []Option{WithDNSNames("a.example.org", "b.example.org")}, []Option{WithDNSNames("b.example.org", "a.example.org")}, false, true},
+		{"DNS SAN added", []Option{WithDNSNames("a.example.org")}, []Option{WithDNSNames("a.example.org", "b.example.org")}, false, false},
+		{"DNS SAN removed", []Option{WithDNSNames("a.example.org", "b.example.org")}, []Option{WithDNSNames("a.example.org")}, false, false},
+		{"SPIFFE ID added", nil, []Option{WithSPIFFEID(spiffeID)}, false, false},
+		{"key type changed", []Option{WithKeyType(KeyECDSAP256)}, []Option{WithKeyType(KeyEd25519)}, false, false},
+		{"same key type", []Option{WithKeyType(KeyECDSAP256)}, []Option{WithKeyType(KeyECDSAP256)}, false, true},
+		{"CA rotated", nil, nil, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, issuer := newTestIssuer(t)
+			cache := WithCache(t.TempDir(), time.Minute)
+			cached, _ := startTestRotater(t, issuer, append(test.cached, cache)...)
+			cached.Stop()
+			if test.rotateCA {
+				if err := server.RotateCA(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			rotater, _ := startTestRotater(t, issuer, append(test.options, cache)...)
+			if reused := server.Requests(vaulttest.EndpointIssue)+server.Requests(vaulttest.EndpointSign) == 1; reused != test.reused {
+				t.Errorf("Cached certificate reused: %v, want %v", reused, test.reused)
+			}
+			if err := rotater.matchesRequest(rotater.keypair().Leaf); err != nil {
+				t.Errorf("Serving a certificate not matching the request: %v", err)
+			}
+			if err := verifyLeaf(rotater, rotater.keypair().Leaf); err != nil {
+				t.Errorf("Serving an untrusted certificate: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+)
+
+// ServerTLSConfig returns a tls.Config for servers presenting the rotated
+// certificate. Client certificates are required and verified against the
+// trust bundle current at the time of each handshake, and against the CRL if
+// CRL checking is enabled.
+func (rotater *TLSRotater) ServerTLSConfig() *tls.Config {
+	return NewIdentities(rotater).ServerTLSConfig()
+}
+
+// ServerTLSConfig returns a tls.Config for servers presenting the identity
+// selected by the server name of each handshake. Client certificates are
+// required and have to be accepted by one of the identities. The security
+// profile is that of the fallback identity.
+func (identities *Identities) ServerTLSConfig() *tls.Config {
+	config := &tls.Config{
+		GetCertificate: identities.GetCertificateFunc(),
+		ClientAuth:     tls.RequireAndVerifyClientCert,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			return identities.verifyPeer(state, x509.ExtKeyUsageClientAuth, "")
+		},
+	}
+	identities.fallback.securityProfile.apply(config)
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		connConfig := config.Clone()
+		connConfig.GetConfigForClient = nil
+		connConfig.ClientCAs = identities.CertPool()
+		return connConfig, nil
+	}
+	return config
+}
+
+// ClientTLSConfig returns a tls.Config for clients presenting the rotated
+// certificate. Servers are verified against the trust bundle current at the
+// time of each handshake, and against the ServerName of the config, or else
+// the server name of the handshake. As the latter is empty when dialling an IP
+// address, its handshakes fail unless ServerName is set or DialTLSContext is
+// used.
+func (rotater *TLSRotater) ClientTLSConfig() *tls.Config {
+	return NewIdentities(rotater).ClientTLSConfig()
+}
+
+// ClientTLSConfig returns a tls.Config for clients presenting the identity
+// issued by a CA the server accepts. Servers have to be accepted by one of
+// the identities, for the server name as described for
+// TLSRotater.ClientTLSConfig. The security profile is that of the fallback
+// identity.
+func (identities *Identities) ClientTLSConfig() *tls.Config {
+	config := &tls.Config{
+		GetClientCertificate: identities.GetClientCertificateFunc(),
+		// The default verification would use a fixed RootCAs pool, so it is
+		// replaced by VerifyConnection.
+		InsecureSkipVerify: true,
+	}
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		// Copies of the config made by tls.Dial and http.Transport set
+		// ServerName to the dialled host, but VerifyConnection only sees
+		// this config, and the handshake leaves out IP addresses.
+		serverName := config.ServerName
+		if serverName == "" {
+			serverName = state.ServerName
+		}
+		if serverName == "" {
+			return fmt.Errorf("No server name to verify the server certificate against")
+		}
+		return identities.verifyPeer(state, x509.ExtKeyUsageServerAuth, serverName)
+	}
+	identities.fallback.securityProfile.apply(config)
+	return config
+}
+
+// DialTLSContext connects to the address with a ClientTLSConfig, verifying
+// the server against the dialled host, be it a name or an IP address. It can
+// be used as the DialTLSContext of an http.Transport.
+func (rotater *TLSRotater) DialTLSContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return NewIdentities(rotater).DialTLSContext(ctx, network, addr)
+}
+
+// DialTLSContext connects to the address with a ClientTLSConfig, verifying
+// the server against the dialled host, be it a name or an IP address. It can
+// be used as the DialTLSContext of an http.Transport.
+func (identities *Identities) DialTLSContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	config := identities.ClientTLSConfig()
+	config.ServerName = host
+	dialer := &tls.Dialer{Config: config}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// verifyPeer verifies the certificate chain presented by a peer against the
+// current trust bundle and CRL, and that it is valid for the given host name
+// unless that is empty.
+func (rotater *TLSRotater) verifyPeer(state tls.ConnectionState, usage x509.ExtKeyUsage, dnsName string) error {
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("Peer presented no certificate")
+	}
+	options := x509.VerifyOptions{
+		Roots:         rotater.CertPool(),
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+		DNSName:       dnsName,
+	}
+	for _, intermediate := range state.PeerCertificates[1:] {
+		options.Intermediates.AddCert(intermediate)
+	}
+	if _, err := state.PeerCertificates[0].Verify(options); err != nil {
+		return err
+	}
+	return rotater.checkRevocation(state.PeerCertificates[0])
+}
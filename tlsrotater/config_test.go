@@ -0,0 +1,70 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientTLSConfigVerifiesServerName(t *testing.T) {
+	tests := []struct {
+		name       string
+		serverIP   bool
+		serverName string
+		dial       bool
+		wantErr    bool
+	}{
+		{"IP address not in certificate", false, "", true, true},
+		{"IP address in certificate", true, "", true, false},
+		{"IP address without dialled host", true, "", false, true},
+		{"server name in certificate", false, "server.example.org", false, false},
+		{"server name not in certificate", true, "other.example.org", false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, issuer := newTestIssuer(t)
+			serverOptions := []Option{WithDNSNames("server.example.org")}
+			if test.serverIP {
+				serverOptions = append(serverOptions, WithIPAddresses(net.ParseIP("127.0.0.1")))
+			}
+			server, _ := startTestRotater(t, issuer, serverOptions...)
+			client, _ := startTestRotater(t, issuer)
+			backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			backend.TLS = server.ServerTLSConfig()
+			backend.StartTLS()
+			defer backend.Close()
+
+			config := client.ClientTLSConfig()
+			config.ServerName = test.serverName
+			transport := &http.Transport{TLSClientConfig: config}
+			if test.dial {
+				transport.DialTLSContext = client.DialTLSContext
+			}
+			response, err := (&http.Client{Transport: transport}).Get(backend.URL)
+			if err == nil {
+				response.Body.Close()
+			}
+			if (err != nil) != test.wantErr {
+				t.Errorf("Request returned %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+	"time"
+)
+
+// CRLPolicy decides whether peers are accepted when no fresh certificate
+// revocation list is available.
+type CRLPolicy int
+
+const (
+	// CRLFailOpen accepts peers when the CRL couldn't be fetched or is stale.
+	CRLFailOpen CRLPolicy = iota
+	// CRLFailClosed rejects peers when the CRL couldn't be fetched or is
+	// stale.
+	CRLFailClosed
+)
+
+var crlPolicyNames = map[CRLPolicy]string{
+	CRLFailOpen:   "open",
+	CRLFailClosed: "closed",
+}
+
+func (policy CRLPolicy) String() string {
+	if name, ok := crlPolicyNames[policy]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseCRLPolicy parses the name of a CRL policy: "open" or "closed".
+func ParseCRLPolicy(name string) (CRLPolicy, error) {
+	for policy, policyName := range crlPolicyNames {
+		if policyName == name {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown CRL policy %q", name)
+}
+
+// CRLSource is implemented by Issuers that publish a certificate revocation
+// list for the certificates they issue.
+type CRLSource interface {
+	// CRL returns the current DER encoded certificate revocation list.
+	CRL() ([]byte, error)
+}
+
+// revocationList is the last certificate revocation list fetched.
+type revocationList struct {
+	revoked    map[string]bool
+	fetched    time.Time
+	nextUpdate time.Time
+}
+
+// stale reports whether the list is too old to be relied upon.
+func (list *revocationList) stale(now time.Time, maxStaleness time.Duration) bool {
+	if !list.nextUpdate.IsZero() && now.After(list.nextUpdate) {
+		return true
+	}
+	return now.Sub(list.fetched) > maxStaleness
+}
+
+// refreshCRL fetches the certificate revocation list from the Issuer and
+// keeps it if it is signed by a trusted root.
+func (rotater *TLSRotater) refreshCRL() error {
+	source, ok := rotater.issuer.(CRLSource)
+	if !ok {
+		return fmt.Errorf("Issuer doesn't publish a CRL")
+	}
+	der, err := source.CRL()
+	if err != nil {
+		return fmt.Errorf("Couldn't fetch CRL: %v", err)
+	}
+	list, err := x509.ParseRevocationList(der)
+	if err != nil {
+		return fmt.Errorf("Couldn't parse CRL: %v", err)
+	}
+	signed := false
+	for _, root := range rotater.trust.certificates() {
+		if list.CheckSignatureFrom(root) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return fmt.Errorf("CRL isn't signed by a trusted root")
+	}
+	revoked := make(map[string]bool, len(list.RevokedCertificateEntries))
+	for _, entry := range list.RevokedCertificateEntries {
+		revoked[entry.SerialNumber.String()] = true
+	}
+	rotater.crl.Store(&revocationList{
+		revoked:    revoked,
+		fetched:    time.Now(),
+		nextUpdate: list.NextUpdate,
+	})
+	return nil
+}
+
+// refreshCRLLogged fetches the CRL, if CRL checking is enabled, logging
+// failures.
+func (rotater *TLSRotater) refreshCRLLogged() {
+	if !rotater.crlChecking {
+		return
+	}
+	if err := rotater.refreshCRL(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error while refreshing CRL (fail %v): %v\n", rotater.crlPolicy, err)
+	}
+}
+
+// checkRevocation rejects a peer certificate that is on the CRL. Without a
+// fresh CRL the peer is accepted or rejected according to the CRL policy.
+func (rotater *TLSRotater) checkRevocation(certificate *x509.Certificate) error {
+	if !rotater.crlChecking {
+		return nil
+	}
+	list := rotater.crl.Load()
+	if list == nil || list.stale(time.Now(), rotater.crlMaxStaleness) {
+		if rotater.crlPolicy == CRLFailClosed {
+			return fmt.Errorf("No fresh CRL to check certificate %v against", certificate.SerialNumber)
+		}
+		return nil
+	}
+	if list.revoked[certificate.SerialNumber.String()] {
+		return fmt.Errorf("Certificate %v has been revoked", certificate.SerialNumber)
+	}
+	return nil
+}
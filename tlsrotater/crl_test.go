@@ -0,0 +1,69 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sirlatrom/tls-sidecar-playground/tlsrotater/vaulttest"
+)
+
+func TestCRL(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     CRLPolicy
+		fault      vaulttest.Fault
+		revokePeer bool
+		wantErr    bool
+	}{
+		{"good peer", CRLFailClosed, vaulttest.Fault{}, false, false},
+		{"revoked peer", CRLFailClosed, vaulttest.Fault{}, true, true},
+		{"revoked peer, failing open", CRLFailOpen, vaulttest.Fault{}, true, true},
+		{"unavailable, failing closed", CRLFailClosed, vaulttest.Fault{Status: http.StatusServiceUnavailable}, false, true},
+		{"unavailable, failing open", CRLFailOpen, vaulttest.Fault{Status: http.StatusServiceUnavailable}, false, false},
+		{"malformed, failing closed", CRLFailClosed, vaulttest.Fault{Malformed: true}, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, issuer := newTestIssuer(t)
+			server.Inject(vaulttest.EndpointCRL, test.fault)
+			rotater, _ := startTestRotater(t, issuer, WithCRLChecking(time.Minute, test.policy))
+			peer, err := issuer.Issue(CertificateRequest{CommonName: "peer", TTL: time.Minute})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.revokePeer {
+				if err := issuer.Revoke(peer.Serial); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := rotater.refreshCRL(); (err != nil) != (test.fault != vaulttest.Fault{}) {
+				t.Errorf("Refreshing the CRL returned %v", err)
+			}
+			leaf := peer.Keypair.Leaf
+			if leaf == nil {
+				t.Fatal("Issued certificate has no leaf")
+			}
+			if err := rotater.checkRevocation(leaf); (err != nil) != test.wantErr {
+				t.Errorf("Checking the peer returned %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
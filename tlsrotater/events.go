@@ -0,0 +1,212 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// EventType tells what an Event is about.
+type EventType int
+
+const (
+	// EventRotated means a new certificate is being served.
+	EventRotated EventType = iota
+	// EventRefreshFailed means issuing a new certificate failed.
+	EventRefreshFailed
+	// EventRevocationFailed means revoking a replaced certificate failed.
+	EventRevocationFailed
+)
+
+// Reasons given in failure events.
+const (
+	// ReasonKeyGeneration means the private key couldn't be generated.
+	ReasonKeyGeneration = "key_generation"
+	// ReasonIssue means the Issuer failed to issue a certificate.
+	ReasonIssue = "issue"
+	// ReasonInvalidCertificate means the issued certificate couldn't be used.
+	ReasonInvalidCertificate = "invalid_certificate"
+	// ReasonTrustBundle means the trust bundle couldn't be fetched or loaded.
+	ReasonTrustBundle = "trust_bundle"
+	// ReasonRevoke means the Issuer failed to revoke a certificate.
+	ReasonRevoke = "revoke"
+)
+
+// refreshError is an error of a refresh tagged with the step that failed.
+type refreshError struct {
+	reason string
+	err    error
+}
+
+func (err *refreshError) Error() string {
+	return err.err.Error()
+}
+
+// failureReason returns the reason a refresh failed with the given error.
+func failureReason(err error) string {
+	var refreshErr *refreshError
+	if errors.As(err, &refreshErr) {
+		return refreshErr.reason
+	}
+	return ReasonIssue
+}
+
+func (eventType EventType) String() string {
+	switch eventType {
+	case EventRotated:
+		return "rotated"
+	case EventRefreshFailed:
+		return "refresh failed"
+	case EventRevocationFailed:
+		return "revocation failed"
+	}
+	return "unknown"
+}
+
+// Event describes something that happened to the identity of a TLSRotater.
+type Event struct {
+	Type EventType
+	Time time.Time
+	// OldSerial is the serial of the replaced certificate for EventRotated,
+	// if any, and of the certificate that failed to be revoked for
+	// EventRevocationFailed.
+	OldSerial string
+	// NewSerial, NotAfter and Chain describe the new certificate for
+	// EventRotated. Chain is the PEM encoded chain of the issuing CA.
+	NewSerial string
+	NotAfter  time.Time
+	Chain     []byte
+	// Certificate is the new certificate for EventRotated.
+	Certificate *Certificate
+	// Latency is how long issuing the new certificate took for EventRotated.
+	// It is zero for a certificate loaded from the cache.
+	Latency time.Duration
+	// Err and Reason tell why a failure event happened.
+	Err    error
+	Reason string
+	// Failures is the number of consecutive failures.
+	Failures int
+}
+
+// OnRotate registers a handler called with an EventRotated whenever a new
+// certificate starts being served. Handlers are called synchronously from the
+// rotation and should return quickly.
+func (rotater *TLSRotater) OnRotate(handler func(Event)) {
+	rotater.subscribe(func(event Event) {
+		if event.Type == EventRotated {
+			handler(event)
+		}
+	})
+}
+
+// OnFailure registers a handler called with an EventRefreshFailed or
+// EventRevocationFailed whenever refreshing or revoking fails. Handlers are
+// called synchronously and should return quickly.
+func (rotater *TLSRotater) OnFailure(handler func(Event)) {
+	rotater.subscribe(func(event Event) {
+		if event.Type != EventRotated {
+			handler(event)
+		}
+	})
+}
+
+// Events returns a channel receiving every event. Events are dropped rather
+// than holding up rotation when the channel's buffer is full. The channel is
+// closed once the rotater has shut down after being stopped, including the
+// revocations of the shutdown, so ranging over it ends; it is closed right
+// away if the rotater has already shut down.
+func (rotater *TLSRotater) Events(buffer int) <-chan Event {
+	events := make(chan Event, buffer)
+	// mu keeps events from being sent to once closed, as emit calls handlers
+	// outside of eventsMu.
+	var mu sync.Mutex
+	closed := false
+	closeEvents := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		closed = true
+		close(events)
+	}
+	rotater.eventsMu.Lock()
+	defer rotater.eventsMu.Unlock()
+	if rotater.eventsClosed {
+		closeEvents()
+		return events
+	}
+	rotater.handlers = append(rotater.handlers, func(event Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		if closed {
+			return
+		}
+		select {
+		case events <- event:
+		default:
+		}
+	})
+	rotater.closers = append(rotater.closers, closeEvents)
+	return events
+}
+
+// closeEvents closes the channels returned by Events.
+func (rotater *TLSRotater) closeEvents() {
+	rotater.eventsMu.Lock()
+	closers := rotater.closers
+	rotater.closers = nil
+	rotater.eventsClosed = true
+	rotater.eventsMu.Unlock()
+	for _, closeEvents := range closers {
+		closeEvents()
+	}
+}
+
+func (rotater *TLSRotater) subscribe(handler func(Event)) {
+	rotater.eventsMu.Lock()
+	defer rotater.eventsMu.Unlock()
+	rotater.handlers = append(rotater.handlers, handler)
+}
+
+// emit calls every handler with the event.
+func (rotater *TLSRotater) emit(event Event) {
+	event.Time = time.Now()
+	rotater.eventsMu.Lock()
+	handlers := rotater.handlers
+	rotater.eventsMu.Unlock()
+	for _, handler := range handlers {
+		handler(event)
+	}
+}
+
+// rotated emits an EventRotated for a new certificate replacing previous,
+// which may be nil.
+func (rotater *TLSRotater) rotated(certificate, previous *Certificate, latency time.Duration) {
+	event := Event{
+		Type:        EventRotated,
+		NewSerial:   certificate.Serial,
+		NotAfter:    certificate.Keypair.Leaf.NotAfter,
+		Chain:       certificate.CAChain,
+		Certificate: certificate,
+		Latency:     latency,
+	}
+	if previous != nil {
+		event.OldSerial = previous.Serial
+	}
+	rotater.emit(event)
+}
@@ -0,0 +1,84 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sirlatrom/tls-sidecar-playground/tlsrotater/vaulttest"
+)
+
+// drainEvents returns the events received until the channel is closed.
+func drainEvents(t *testing.T, events <-chan Event) []Event {
+	t.Helper()
+	var received []Event
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return received
+			}
+			received = append(received, event)
+		case <-timeout:
+			t.Fatal("Events not closed")
+		}
+	}
+}
+
+func TestEventsClosedOnShutdown(t *testing.T) {
+	tests := []struct {
+		name string
+		stop func(rotater *TLSRotater, cancel context.CancelFunc)
+	}{
+		{"stopped", func(rotater *TLSRotater, cancel context.CancelFunc) {
+			rotater.Stop()
+		}},
+		{"context cancelled", func(rotater *TLSRotater, cancel context.CancelFunc) {
+			cancel()
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, issuer := newTestIssuer(t)
+			rotater := NewTLSRotater(issuer, "test", WithBackoff(testBackoff), WithRevokeOnStop(true))
+			events := rotater.Events(64)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if err := rotater.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer rotater.Stop()
+			server.Inject(vaulttest.EndpointRevoke, vaulttest.Fault{Status: http.StatusServiceUnavailable})
+			test.stop(rotater, cancel)
+
+			received := drainEvents(t, events)
+			if len(received) != 2 || received[0].Type != EventRotated || received[1].Type != EventRevocationFailed {
+				t.Errorf("Received %v, want the rotation and the failed revocation on shutdown", received)
+			}
+			// Events emitted after shutdown are dropped
+			rotater.emit(Event{Type: EventRefreshFailed})
+			if late := rotater.Events(1); len(drainEvents(t, late)) != 0 {
+				t.Error("Events after shutdown received events")
+			}
+		})
+	}
+}
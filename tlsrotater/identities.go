@@ -0,0 +1,143 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"strings"
+)
+
+// Identities presents one of several identities, each kept by its own
+// TLSRotater, depending on the peer. Servers select the identity by the server
+// name the client asks for, and clients by the CAs the server accepts.
+type Identities struct {
+	fallback *TLSRotater
+	rotaters []*TLSRotater
+	byName   map[string]*TLSRotater
+}
+
+// NewIdentities creates Identities falling back to the identity of the first
+// rotater. The server names of an identity are the common name and DNS SANs
+// its rotater requests; a name requested by several rotaters selects the
+// first of them. The rotaters are started and stopped by the caller.
+func NewIdentities(fallback *TLSRotater, rotaters ...*TLSRotater) *Identities {
+	identities := &Identities{
+		fallback: fallback,
+		rotaters: append([]*TLSRotater{fallback}, rotaters...),
+		byName:   make(map[string]*TLSRotater),
+	}
+	for _, rotater := range identities.rotaters {
+		names := append([]string{rotater.request.CommonName}, rotater.request.DNSNames...)
+		for _, name := range names {
+			name = normalizeServerName(name)
+			if _, ok := identities.byName[name]; !ok {
+				identities.byName[name] = rotater
+			}
+		}
+	}
+	return identities
+}
+
+// forServerName returns the rotater of the identity for a server name,
+// matching it exactly or against a wildcard name, or else the fallback.
+func (identities *Identities) forServerName(serverName string) *TLSRotater {
+	name := normalizeServerName(serverName)
+	if rotater, ok := identities.byName[name]; ok {
+		return rotater
+	}
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		if rotater, ok := identities.byName["*"+name[i:]]; ok {
+			return rotater
+		}
+	}
+	return identities.fallback
+}
+
+// GetCertificateFunc returns a function for tls.Config.GetCertificate that
+// presents the identity for the server name of each handshake.
+func (identities *Identities) GetCertificateFunc() func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return identities.forServerName(clientHello.ServerName).keypair(), nil
+	}
+}
+
+// GetClientCertificateFunc returns a function for
+// tls.Config.GetClientCertificate that presents the first identity issued by
+// a CA the server accepts, or the fallback if the server doesn't say.
+func (identities *Identities) GetClientCertificateFunc() func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return func(requestInfo *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		if len(requestInfo.AcceptableCAs) == 0 {
+			return identities.fallback.keypair(), nil
+		}
+		for _, rotater := range identities.rotaters {
+			keypair := rotater.keypair()
+			if keypair != nil && requestInfo.SupportsCertificate(keypair) == nil {
+				return keypair, nil
+			}
+		}
+		var acceptable []string
+		for _, rawName := range requestInfo.AcceptableCAs {
+			var name pkix.RDNSequence
+			if _, err := asn1.Unmarshal(rawName, &name); err != nil {
+				continue
+			}
+			var subject pkix.Name
+			subject.FillFromRDNSequence(&name)
+			acceptable = append(acceptable, subject.String())
+		}
+		return nil, fmt.Errorf("No identity issued by a CA the server accepts: %v", strings.Join(acceptable, "; "))
+	}
+}
+
+// CertPool returns the roots currently trusted by any of the identities.
+func (identities *Identities) CertPool() *x509.CertPool {
+	if len(identities.rotaters) == 1 {
+		return identities.fallback.CertPool()
+	}
+	pool := x509.NewCertPool()
+	for _, rotater := range identities.rotaters {
+		for _, root := range rotater.trust.certificates() {
+			pool.AddCert(root)
+		}
+	}
+	return pool
+}
+
+// verifyPeer accepts a peer that any of the identities accepts.
+func (identities *Identities) verifyPeer(state tls.ConnectionState, usage x509.ExtKeyUsage, dnsName string) error {
+	var firstErr error
+	for _, rotater := range identities.rotaters {
+		err := rotater.verifyPeer(state, usage, dnsName)
+		if err == nil {
+			return nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// normalizeServerName lower cases a server name and drops a trailing dot.
+func normalizeServerName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
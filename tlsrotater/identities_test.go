@@ -0,0 +1,99 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+)
+
+func TestIdentitiesClientCertificate(t *testing.T) {
+	serverA, issuerA := newTestIssuer(t)
+	serverB, issuerB := newTestIssuer(t)
+	serverC, _ := newTestIssuer(t)
+	rotaterA, _ := startTestRotater(t, issuerA)
+	rotaterB, _ := startTestRotater(t, issuerB)
+	identities := NewIdentities(rotaterA, rotaterB)
+	tests := []struct {
+		name    string
+		cas     []*x509.Certificate
+		want    *TLSRotater
+		wantErr bool
+	}{
+		{"server doesn't say", nil, rotaterA, false},
+		{"first CA", []*x509.Certificate{serverA.CA()}, rotaterA, false},
+		{"second CA", []*x509.Certificate{serverB.CA()}, rotaterB, false},
+		{"both CAs", []*x509.Certificate{serverB.CA(), serverA.CA()}, rotaterA, false},
+		{"unknown CA", []*x509.Certificate{serverC.CA()}, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requestInfo := &tls.CertificateRequestInfo{
+				Version: tls.VersionTLS13,
+				SignatureSchemes: []tls.SignatureScheme{
+					tls.ECDSAWithP256AndSHA256, tls.ECDSAWithP384AndSHA384,
+					tls.PSSWithSHA256, tls.PKCS1WithSHA256, tls.Ed25519,
+				},
+			}
+			for _, ca := range test.cas {
+				requestInfo.AcceptableCAs = append(requestInfo.AcceptableCAs, ca.RawSubject)
+			}
+			keypair, err := identities.GetClientCertificateFunc()(requestInfo)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("Presented %v, want an error", keypair.Leaf.Issuer)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keypair != test.want.keypair() {
+				t.Errorf("Presented the identity issued by %v, want the one issued by %v", keypair.Leaf.Issuer, test.want.keypair().Leaf.Issuer)
+			}
+		})
+	}
+}
+
+func TestIdentitiesServerCertificate(t *testing.T) {
+	_, issuer := newTestIssuer(t)
+	fallback, _ := startTestRotater(t, issuer, WithDNSNames("a.example.org"))
+	other, _ := startTestRotater(t, issuer, WithDNSNames("b.example.org", "*.c.example.org"))
+	identities := NewIdentities(fallback, other)
+	tests := []struct {
+		serverName string
+		want       *TLSRotater
+	}{
+		{"", fallback},
+		{"a.example.org", fallback},
+		{"B.example.org.", other},
+		{"x.c.example.org", other},
+		{"x.y.c.example.org", fallback},
+		{"unknown.example.org", fallback},
+	}
+	for _, test := range tests {
+		keypair, err := identities.GetCertificateFunc()(&tls.ClientHelloInfo{ServerName: test.serverName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keypair != test.want.keypair() {
+			t.Errorf("Presented %v for %q", keypair.Leaf.DNSNames, test.serverName)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"crypto"
+	"crypto/tls"
+	"net"
+	"net/url"
+	"time"
+)
+
+// Issuer is a backend able to issue and revoke certificates for a TLSRotater.
+type Issuer interface {
+	// Issue requests a new certificate.
+	Issue(request CertificateRequest) (*Certificate, error)
+	// Revoke revokes the certificate with the given serial number.
+	Revoke(serial string) error
+	// TrustBundle returns the PEM encoded CA certificates that peers are
+	// verified against.
+	TrustBundle() ([]byte, error)
+}
+
+// CertificateRequest describes the certificate wanted from an Issuer.
+type CertificateRequest struct {
+	CommonName  string
+	DNSNames    []string
+	IPAddresses []net.IP
+	URIs        []*url.URL
+	// TTL is the requested lifetime. Zero leaves it up to the Issuer.
+	TTL time.Duration
+	// ExcludeCNFromSANs keeps the common name out of the DNS and email SANs.
+	ExcludeCNFromSANs bool
+	// Key is the private key to get a certificate for. If nil, the Issuer
+	// generates one.
+	Key crypto.Signer
+}
+
+// Certificate is a keypair issued by an Issuer.
+type Certificate struct {
+	Keypair *tls.Certificate
+	Serial  string
+	// CAChain is the PEM encoded chain of the issuing CA.
+	CAChain []byte
+}
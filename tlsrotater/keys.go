@@ -0,0 +1,117 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+)
+
+// KeyType is the kind of private key a TLSRotater generates for its
+// certificates.
+type KeyType int
+
+const (
+	// KeyIssuerGenerated leaves generating the private key to the Issuer,
+	// which for a VaultIssuer means Vault sends it over the wire.
+	KeyIssuerGenerated KeyType = iota
+	// KeyECDSAP256 is an ECDSA key on the P-256 curve.
+	KeyECDSAP256
+	// KeyECDSAP384 is an ECDSA key on the P-384 curve.
+	KeyECDSAP384
+	// KeyRSA2048 is a 2048 bit RSA key.
+	KeyRSA2048
+	// KeyRSA4096 is a 4096 bit RSA key.
+	KeyRSA4096
+	// KeyEd25519 is an Ed25519 key.
+	KeyEd25519
+)
+
+var keyTypeNames = map[KeyType]string{
+	KeyIssuerGenerated: "issuer",
+	KeyECDSAP256:       "ec-p256",
+	KeyECDSAP384:       "ec-p384",
+	KeyRSA2048:         "rsa-2048",
+	KeyRSA4096:         "rsa-4096",
+	KeyEd25519:         "ed25519",
+}
+
+func (keyType KeyType) String() string {
+	if name, ok := keyTypeNames[keyType]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseKeyType parses the name of a key type: "issuer", "ec-p256", "ec-p384",
+// "rsa-2048", "rsa-4096" or "ed25519".
+func ParseKeyType(name string) (KeyType, error) {
+	for keyType, keyTypeName := range keyTypeNames {
+		if keyTypeName == name {
+			return keyType, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown key type %q", name)
+}
+
+// generateKey generates a private key of the given type.
+func generateKey(keyType KeyType) (crypto.Signer, error) {
+	switch keyType {
+	case KeyECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case KeyEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("Can't generate a key of type %v", keyType)
+}
+
+// keyTypeOf returns the type of a public key, or KeyIssuerGenerated if it is
+// none of the types a TLSRotater generates.
+func keyTypeOf(publicKey crypto.PublicKey) KeyType {
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return KeyECDSAP256
+		case elliptic.P384():
+			return KeyECDSAP384
+		}
+	case *rsa.PublicKey:
+		switch key.N.BitLen() {
+		case 2048:
+			return KeyRSA2048
+		case 4096:
+			return KeyRSA4096
+		}
+	case ed25519.PublicKey:
+		return KeyEd25519
+	}
+	return KeyIssuerGenerated
+}
@@ -0,0 +1,70 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// DefaultServiceAccountTokenFile is where Kubernetes mounts the service
+// account token of a pod.
+const DefaultServiceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// Kubernetes is an Authenticator logging in with Vault's Kubernetes auth
+// method using the service account token of the pod. The token file is read
+// again on every login, so projected tokens rotated by the kubelet are picked
+// up.
+type Kubernetes struct {
+	// Mount is the path the Kubernetes auth method is mounted at. Defaults
+	// to "kubernetes".
+	Mount string
+	// Role is the Vault role to log in as.
+	Role string
+	// TokenFile is the service account token. Defaults to
+	// DefaultServiceAccountTokenFile.
+	TokenFile string
+}
+
+// Login implements Authenticator.
+func (kubernetes *Kubernetes) Login(client *vaultapi.Client) (*vaultapi.Secret, error) {
+	tokenFile := kubernetes.TokenFile
+	if tokenFile == "" {
+		tokenFile = DefaultServiceAccountTokenFile
+	}
+	contents, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+
+	mount := kubernetes.Mount
+	if mount == "" {
+		mount = "kubernetes"
+	}
+	params := make(map[string]interface{})
+	params["role"] = kubernetes.Role
+	params["jwt"] = strings.TrimSpace(string(contents))
+	secret, err := loginWith(client, mount, params)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't log in with Kubernetes service account: %v", err)
+	}
+	return secret, nil
+}
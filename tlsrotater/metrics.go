@@ -0,0 +1,190 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// issuanceBuckets are the upper bounds in seconds of the issuance latency
+// histogram.
+var issuanceBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics collects metrics about the certificate lifecycle of TLSRotaters
+// and serves them in the Prometheus text exposition format. The metrics of
+// each rotater are labelled with the common name it requests as identity.
+type Metrics struct {
+	mu         sync.Mutex
+	identities []*identityMetrics
+}
+
+// identityMetrics counts the events of one rotater.
+type identityMetrics struct {
+	identity string
+	rotater  *TLSRotater
+
+	rotations       uint64
+	failures        map[string]uint64
+	issuanceCounts  []uint64
+	issuanceSum     float64
+	issuanceSamples uint64
+}
+
+// NewMetrics creates Metrics for the given rotaters. They have to be
+// registered before they are started to count their first issuance.
+func NewMetrics(rotaters ...*TLSRotater) *Metrics {
+	metrics := &Metrics{}
+	for _, rotater := range rotaters {
+		metrics.Register(rotater)
+	}
+	return metrics
+}
+
+// Register adds a rotater to the metrics. It has to be registered before it
+// is started to count its first issuance.
+func (metrics *Metrics) Register(rotater *TLSRotater) {
+	identity := &identityMetrics{
+		identity:       rotater.request.CommonName,
+		rotater:        rotater,
+		failures:       make(map[string]uint64),
+		issuanceCounts: make([]uint64, len(issuanceBuckets)),
+	}
+	metrics.mu.Lock()
+	metrics.identities = append(metrics.identities, identity)
+	metrics.mu.Unlock()
+	rotater.subscribe(func(event Event) {
+		metrics.mu.Lock()
+		defer metrics.mu.Unlock()
+		identity.observe(event)
+	})
+}
+
+// observe counts an event.
+func (identity *identityMetrics) observe(event Event) {
+	switch event.Type {
+	case EventRotated:
+		identity.rotations++
+		if event.Latency == 0 {
+			return
+		}
+		seconds := event.Latency.Seconds()
+		for i, bound := range issuanceBuckets {
+			if seconds <= bound {
+				identity.issuanceCounts[i]++
+			}
+		}
+		identity.issuanceSum += seconds
+		identity.issuanceSamples++
+	default:
+		identity.failures[event.Reason]++
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (metrics *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format.
+func (metrics *Metrics) WriteTo(w io.Writer) (int64, error) {
+	metrics.mu.Lock()
+	identities := append([]*identityMetrics(nil), metrics.identities...)
+	metrics.mu.Unlock()
+	statuses := make([]Status, len(identities))
+	pending := make([]int, len(identities))
+	for i, identity := range identities {
+		statuses[i] = identity.rotater.Status()
+		pending[i] = identity.rotater.PendingRevocations()
+	}
+	var written int64
+	printf := func(format string, args ...interface{}) {
+		n, _ := fmt.Fprintf(w, format, args...)
+		written += int64(n)
+	}
+
+	printf("# HELP tlsrotater_certificate_not_after_seconds Expiry of the current certificate as a Unix timestamp.\n")
+	printf("# TYPE tlsrotater_certificate_not_after_seconds gauge\n")
+	for i, identity := range identities {
+		if !statuses[i].NotAfter.IsZero() {
+			printf("tlsrotater_certificate_not_after_seconds{identity=%q} %d\n", identity.identity, statuses[i].NotAfter.Unix())
+		}
+	}
+	printf("# HELP tlsrotater_certificate_expiry_seconds Seconds until the current certificate expires.\n")
+	printf("# TYPE tlsrotater_certificate_expiry_seconds gauge\n")
+	for i, identity := range identities {
+		if !statuses[i].NotAfter.IsZero() {
+			printf("tlsrotater_certificate_expiry_seconds{identity=%q} %g\n", identity.identity, time.Until(statuses[i].NotAfter).Seconds())
+		}
+	}
+	printf("# HELP tlsrotater_state State of the rotater: 0 starting, 1 healthy, 2 degraded, 3 failed.\n")
+	printf("# TYPE tlsrotater_state gauge\n")
+	for i, identity := range identities {
+		printf("tlsrotater_state{identity=%q} %d\n", identity.identity, statuses[i].State)
+	}
+	printf("# HELP tlsrotater_revocations_pending Replaced certificates waiting to be revoked.\n")
+	printf("# TYPE tlsrotater_revocations_pending gauge\n")
+	for i, identity := range identities {
+		printf("tlsrotater_revocations_pending{identity=%q} %d\n", identity.identity, pending[i])
+	}
+	// The identities share the token of the sidecar
+	for _, status := range statuses {
+		if status.Token != nil && !status.Token.Expires.IsZero() {
+			printf("# HELP tlsrotater_vault_token_ttl_seconds Seconds until the Vault token expires.\n")
+			printf("# TYPE tlsrotater_vault_token_ttl_seconds gauge\n")
+			printf("tlsrotater_vault_token_ttl_seconds %g\n", time.Until(status.Token.Expires).Seconds())
+			break
+		}
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	printf("# HELP tlsrotater_rotations_total Certificates started being served.\n")
+	printf("# TYPE tlsrotater_rotations_total counter\n")
+	for _, identity := range identities {
+		printf("tlsrotater_rotations_total{identity=%q} %d\n", identity.identity, identity.rotations)
+	}
+	printf("# HELP tlsrotater_failures_total Failed refreshes and revocations by reason.\n")
+	printf("# TYPE tlsrotater_failures_total counter\n")
+	for _, identity := range identities {
+		reasons := make([]string, 0, len(identity.failures))
+		for reason := range identity.failures {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		for _, reason := range reasons {
+			printf("tlsrotater_failures_total{identity=%q,reason=%q} %d\n", identity.identity, reason, identity.failures[reason])
+		}
+	}
+	printf("# HELP tlsrotater_issuance_duration_seconds Time taken to issue a certificate.\n")
+	printf("# TYPE tlsrotater_issuance_duration_seconds histogram\n")
+	for _, identity := range identities {
+		for i, bound := range issuanceBuckets {
+			printf("tlsrotater_issuance_duration_seconds_bucket{identity=%q,le=\"%g\"} %d\n", identity.identity, bound, identity.issuanceCounts[i])
+		}
+		printf("tlsrotater_issuance_duration_seconds_bucket{identity=%q,le=\"+Inf\"} %d\n", identity.identity, identity.issuanceSamples)
+		printf("tlsrotater_issuance_duration_seconds_sum{identity=%q} %g\n", identity.identity, identity.issuanceSum)
+		printf("tlsrotater_issuance_duration_seconds_count{identity=%q} %d\n", identity.identity, identity.issuanceSamples)
+	}
+	return written, nil
+}
@@ -0,0 +1,126 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirlatrom/tls-sidecar-playground/tlsrotater/vaulttest"
+)
+
+// parseExposition returns the samples of a Prometheus text exposition by
+// name and labels, and how often each family is described.
+func parseExposition(t *testing.T, exposition string) (map[string]string, map[string]int) {
+	t.Helper()
+	samples := make(map[string]string)
+	described := make(map[string]int)
+	for _, line := range strings.Split(strings.TrimSpace(exposition), "\n") {
+		if strings.HasPrefix(line, "# TYPE ") {
+			described[strings.Fields(line)[2]]++
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 {
+			t.Fatalf("Malformed sample %q", line)
+		}
+		samples[line[:i]] = line[i+1:]
+	}
+	return samples, described
+}
+
+func TestMetrics(t *testing.T) {
+	server, issuer := newTestIssuer(t)
+	primary := NewTLSRotater(issuer, "main", WithBackoff(testBackoff))
+	extra := NewTLSRotater(issuer, "extra", WithBackoff(testBackoff), WithRevocationPolicy(RevokeImmediately))
+	metrics := NewMetrics(primary)
+	metrics.Register(extra)
+
+	// The first issuance of main falls in the 0.25 second bucket
+	server.Inject(vaulttest.EndpointIssue, vaulttest.Fault{Latency: 150 * time.Millisecond, Count: 1})
+	for _, rotater := range []*TLSRotater{primary, extra} {
+		if err := rotater.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		defer rotater.Stop()
+	}
+	failures := []struct {
+		rotater  *TLSRotater
+		endpoint string
+		fault    vaulttest.Fault
+	}{
+		{primary, vaulttest.EndpointIssue, vaulttest.Fault{Status: http.StatusServiceUnavailable, Count: 1}},
+		{primary, vaulttest.EndpointIssue, vaulttest.Fault{Malformed: true, Count: 1}},
+		{primary, vaulttest.EndpointCA, vaulttest.Fault{Status: http.StatusInternalServerError, Count: 1}},
+		{extra, vaulttest.EndpointRevoke, vaulttest.Fault{Status: http.StatusServiceUnavailable}},
+	}
+	for _, failure := range failures {
+		server.Inject(failure.endpoint, failure.fault)
+		failure.rotater.recordRefresh(failure.rotater.refresh())
+	}
+
+	var exposition bytes.Buffer
+	if _, err := metrics.WriteTo(&exposition); err != nil {
+		t.Fatal(err)
+	}
+	samples, described := parseExposition(t, exposition.String())
+	want := map[string]string{
+		`tlsrotater_state{identity="main"}`:                                       "2",
+		`tlsrotater_state{identity="extra"}`:                                      "1",
+		`tlsrotater_rotations_total{identity="main"}`:                             "1",
+		`tlsrotater_rotations_total{identity="extra"}`:                            "2",
+		`tlsrotater_failures_total{identity="main",reason="issue"}`:               "2",
+		`tlsrotater_failures_total{identity="main",reason="trust_bundle"}`:        "1",
+		`tlsrotater_failures_total{identity="extra",reason="revoke"}`:             "1",
+		`tlsrotater_revocations_pending{identity="main"}`:                         "0",
+		`tlsrotater_revocations_pending{identity="extra"}`:                        "1",
+		`tlsrotater_issuance_duration_seconds_bucket{identity="main",le="0.1"}`:   "0",
+		`tlsrotater_issuance_duration_seconds_bucket{identity="main",le="0.25"}`:  "1",
+		`tlsrotater_issuance_duration_seconds_bucket{identity="main",le="10"}`:    "1",
+		`tlsrotater_issuance_duration_seconds_bucket{identity="main",le="+Inf"}`:  "1",
+		`tlsrotater_issuance_duration_seconds_count{identity="main"}`:             "1",
+		`tlsrotater_issuance_duration_seconds_bucket{identity="extra",le="+Inf"}`: "2",
+		`tlsrotater_issuance_duration_seconds_count{identity="extra"}`:            "2",
+	}
+	for sample, value := range want {
+		if samples[sample] != value {
+			t.Errorf("%v is %q, want %q", sample, samples[sample], value)
+		}
+	}
+	for _, identity := range []string{"main", "extra"} {
+		if _, ok := samples[`tlsrotater_certificate_not_after_seconds{identity="`+identity+`"}`]; !ok {
+			t.Errorf("No certificate expiry for %v", identity)
+		}
+	}
+	for family, count := range described {
+		if count != 1 {
+			t.Errorf("%v described %d times", family, count)
+		}
+	}
+	if sum, err := strconv.ParseFloat(samples[`tlsrotater_issuance_duration_seconds_sum{identity="main"}`], 64); err != nil || sum < 0.15 {
+		t.Errorf("Issuance duration sum of main is %v (%v), want at least 0.15", sum, err)
+	}
+}
@@ -0,0 +1,178 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// ocspRetryInterval is how long to wait before fetching an OCSP response
+	// again after failing to.
+	ocspRetryInterval = time.Minute
+	// ocspRefreshInterval is how often to fetch an OCSP response that doesn't
+	// say when the next update is due.
+	ocspRefreshInterval = time.Hour
+	// ocspTimeout bounds a request to a configured OCSP responder.
+	ocspTimeout = 10 * time.Second
+)
+
+// OCSPResponder is implemented by Issuers that can answer OCSP requests for
+// the certificates they issue.
+type OCSPResponder interface {
+	// OCSP returns the DER encoded response to a DER encoded OCSP request.
+	OCSP(request []byte) ([]byte, error)
+}
+
+// ocspStaple is an OCSP response for the certificate with the given serial.
+type ocspStaple struct {
+	serial     string
+	raw        []byte
+	thisUpdate time.Time
+	nextUpdate time.Time
+}
+
+// valid reports whether the staple may still be served.
+func (staple *ocspStaple) valid(now time.Time) bool {
+	return staple.nextUpdate.IsZero() || now.Before(staple.nextUpdate)
+}
+
+// stapled returns the keypair of the certificate with its OCSP response
+// attached, if there is a current one for it.
+func (rotater *TLSRotater) stapled(certificate *Certificate) *tls.Certificate {
+	staple := rotater.staple.Load()
+	if staple == nil || staple.serial != certificate.Serial || !staple.valid(time.Now()) {
+		return certificate.Keypair
+	}
+	keypair := *certificate.Keypair
+	keypair.OCSPStaple = staple.raw
+	return &keypair
+}
+
+// refreshStaple fetches an OCSP response for the current certificate and
+// staples it if the certificate is good.
+func (rotater *TLSRotater) refreshStaple() error {
+	certificate := rotater.current.Load()
+	if certificate == nil {
+		return nil
+	}
+	leaf := certificate.Keypair.Leaf
+	issuer, err := issuingCA(certificate.CAChain)
+	if err != nil {
+		return err
+	}
+	request, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return fmt.Errorf("Couldn't create OCSP request: %v", err)
+	}
+	raw, err := rotater.queryOCSP(leaf, request)
+	if err != nil {
+		return err
+	}
+	response, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return fmt.Errorf("Couldn't parse OCSP response: %v", err)
+	}
+	if response.Status != ocsp.Good {
+		return fmt.Errorf("OCSP responder says certificate %v is not good (status %d)", certificate.Serial, response.Status)
+	}
+	rotater.staple.Store(&ocspStaple{
+		serial:     certificate.Serial,
+		raw:        raw,
+		thisUpdate: response.ThisUpdate,
+		nextUpdate: response.NextUpdate,
+	})
+	log.Printf("Stapled OCSP response for %v, next update %v\n", certificate.Serial, response.NextUpdate)
+	return nil
+}
+
+// queryOCSP sends an OCSP request to the configured responder, or else to the
+// Issuer if it is an OCSPResponder, or else to the responder named in the
+// certificate.
+func (rotater *TLSRotater) queryOCSP(leaf *x509.Certificate, request []byte) ([]byte, error) {
+	responder := rotater.ocspResponder
+	if responder == "" {
+		if issuer, ok := rotater.issuer.(OCSPResponder); ok {
+			return issuer.OCSP(request)
+		}
+		if len(leaf.OCSPServer) == 0 {
+			return nil, fmt.Errorf("No OCSP responder for certificate")
+		}
+		responder = leaf.OCSPServer[0]
+	}
+	client := &http.Client{Timeout: ocspTimeout}
+	response, err := client.Post(responder, "application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OCSP responder %v returned %v", responder, response.Status)
+	}
+	return ioutil.ReadAll(response.Body)
+}
+
+// nextStapleRefresh returns how long to wait before fetching a new OCSP
+// response: halfway to the next update of the current one.
+func (rotater *TLSRotater) nextStapleRefresh() time.Duration {
+	staple := rotater.staple.Load()
+	certificate := rotater.current.Load()
+	if staple == nil || certificate == nil || staple.serial != certificate.Serial {
+		return ocspRetryInterval
+	}
+	if staple.nextUpdate.IsZero() {
+		return ocspRefreshInterval
+	}
+	wait := time.Until(staple.thisUpdate.Add(staple.nextUpdate.Sub(staple.thisUpdate) / 2))
+	if wait < minRefreshInterval {
+		wait = minRefreshInterval
+	}
+	return wait
+}
+
+// stapleCurrent fetches an OCSP response for the current certificate, if stapling is
+// enabled, logging failures.
+func (rotater *TLSRotater) stapleCurrent() {
+	if !rotater.ocspStapling {
+		return
+	}
+	if err := rotater.refreshStaple(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error while fetching OCSP response: %v\n", err)
+	}
+}
+
+// issuingCA returns the first certificate of a PEM encoded CA chain.
+func issuingCA(chain []byte) (*x509.Certificate, error) {
+	for block, rest := pem.Decode(chain); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+	return nil, fmt.Errorf("No issuing CA in chain")
+}
@@ -0,0 +1,77 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/sirlatrom/tls-sidecar-playground/tlsrotater/vaulttest"
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestOCSPStapling(t *testing.T) {
+	tests := []struct {
+		name       string
+		fault      vaulttest.Fault
+		wantStaple bool
+	}{
+		{"good", vaulttest.Fault{}, true},
+		{"unavailable", vaulttest.Fault{Status: http.StatusServiceUnavailable}, false},
+		{"malformed", vaulttest.Fault{Malformed: true}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, issuer := newTestIssuer(t)
+			server.Inject(vaulttest.EndpointOCSP, test.fault)
+			rotater, _ := startTestRotater(t, issuer, WithOCSPStapling(""))
+			keypair := rotater.keypair()
+			if stapled := len(keypair.OCSPStaple) > 0; stapled != test.wantStaple {
+				t.Fatalf("Stapled: %v, want %v", stapled, test.wantStaple)
+			}
+			if !test.wantStaple {
+				return
+			}
+			response, err := ocsp.ParseResponseForCert(keypair.OCSPStaple, keypair.Leaf, server.CA())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.Status != ocsp.Good {
+				t.Errorf("Stapled status is %d, want good", response.Status)
+			}
+		})
+	}
+}
+
+func TestOCSPStapleRevoked(t *testing.T) {
+	_, issuer := newTestIssuer(t)
+	rotater, _ := startTestRotater(t, issuer, WithOCSPStapling(""))
+	serial := rotater.Status().Serial
+	if err := issuer.Revoke(serial); err != nil {
+		t.Fatal(err)
+	}
+	if err := rotater.refreshStaple(); err == nil {
+		t.Error("Stapled the response for a revoked certificate")
+	}
+	if err := rotater.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if staple := rotater.keypair().OCSPStaple; len(staple) == 0 {
+		t.Error("Replacement certificate wasn't stapled")
+	}
+}
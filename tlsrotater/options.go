@@ -0,0 +1,222 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"net"
+	"net/url"
+	"time"
+)
+
+// Option configures a TLSRotater.
+type Option func(*TLSRotater)
+
+// WithRenewalFraction sets the fraction of a certificate's remaining lifetime
+// after which it is renewed. Defaults to 0.6. It has to be positive, and at
+// most 1 with the renewal jitter added, or Start fails.
+func WithRenewalFraction(fraction float64) Option {
+	return func(rotater *TLSRotater) {
+		rotater.renewalFraction = fraction
+	}
+}
+
+// WithRenewalJitter sets the upper bound of the random fraction of remaining
+// lifetime added to the renewal fraction, so that replicas issued at the same
+// time do not all renew at once. Defaults to 0.2. It must not be negative.
+func WithRenewalJitter(jitter float64) Option {
+	return func(rotater *TLSRotater) {
+		rotater.renewalJitter = jitter
+	}
+}
+
+// WithBackoff sets the retry policy for failed refreshes. Defaults to
+// DefaultBackoff.
+func WithBackoff(backoff Backoff) Option {
+	return func(rotater *TLSRotater) {
+		rotater.backoff = backoff
+	}
+}
+
+// WithDNSNames sets the DNS subject alternative names to request.
+func WithDNSNames(names ...string) Option {
+	return func(rotater *TLSRotater) {
+		rotater.request.DNSNames = names
+	}
+}
+
+// WithIPAddresses sets the IP subject alternative names to request.
+func WithIPAddresses(ips ...net.IP) Option {
+	return func(rotater *TLSRotater) {
+		rotater.request.IPAddresses = ips
+	}
+}
+
+// WithURIs sets the URI subject alternative names to request.
+func WithURIs(uris ...*url.URL) Option {
+	return func(rotater *TLSRotater) {
+		rotater.request.URIs = uris
+	}
+}
+
+// WithSPIFFEID requests the SPIFFE ID as a URI SAN, in addition to those
+// set with WithURIs.
+func WithSPIFFEID(id SPIFFEID) Option {
+	return func(rotater *TLSRotater) {
+		rotater.spiffeID = &id
+	}
+}
+
+// WithTTL sets the lifetime to request for certificates. Defaults to five
+// minutes. Zero leaves it up to the Issuer.
+func WithTTL(ttl time.Duration) Option {
+	return func(rotater *TLSRotater) {
+		rotater.request.TTL = ttl
+	}
+}
+
+// WithExcludeCNFromSANs keeps the common name out of the subject alternative
+// names of issued certificates.
+func WithExcludeCNFromSANs(exclude bool) Option {
+	return func(rotater *TLSRotater) {
+		rotater.request.ExcludeCNFromSANs = exclude
+	}
+}
+
+// WithKeyType makes the rotater generate private keys of the given type
+// itself and only send certificate signing requests to the Issuer, so that
+// keys never leave the process. Defaults to KeyIssuerGenerated.
+func WithKeyType(keyType KeyType) Option {
+	return func(rotater *TLSRotater) {
+		rotater.keyType = keyType
+	}
+}
+
+// WithOCSPStapling makes the rotater fetch an OCSP response for each
+// certificate, refresh it before its next update and staple it to the
+// handshakes served through GetCertificateFunc. Responses are fetched from
+// the given responder URL, or if it is empty from the Issuer if it is an
+// OCSPResponder, or else from the responder named in the certificate.
+func WithOCSPStapling(responder string) Option {
+	return func(rotater *TLSRotater) {
+		rotater.ocspStapling = true
+		rotater.ocspResponder = responder
+	}
+}
+
+// WithCRLChecking makes the rotater fetch the certificate revocation list of
+// the Issuer, which has to be a CRLSource, at the given interval and reject
+// revoked peers. Without a fresh CRL peers are accepted or rejected according
+// to the policy. A CRL is stale after its next update or, unless set with
+// WithCRLMaxStaleness, three intervals after it was fetched. The interval has
+// to be positive, or Start fails.
+func WithCRLChecking(interval time.Duration, policy CRLPolicy) Option {
+	return func(rotater *TLSRotater) {
+		rotater.crlChecking = true
+		rotater.crlInterval = interval
+		rotater.crlPolicy = policy
+		if rotater.crlMaxStaleness == 0 {
+			rotater.crlMaxStaleness = 3 * interval
+		}
+	}
+}
+
+// WithCRLMaxStaleness sets how long after being fetched a CRL is relied upon.
+func WithCRLMaxStaleness(maxStaleness time.Duration) Option {
+	return func(rotater *TLSRotater) {
+		rotater.crlMaxStaleness = maxStaleness
+	}
+}
+
+// WithSecurityProfile sets the TLS versions, cipher suites and curves of the
+// configs returned by ServerTLSConfig and ClientTLSConfig. Defaults to
+// ProfileIntermediate.
+func WithSecurityProfile(profile SecurityProfile) Option {
+	return func(rotater *TLSRotater) {
+		rotater.securityProfile = profile
+	}
+}
+
+// WithTrustOverlap sets how long roots that have disappeared from the trust
+// bundle are still trusted, counted from the first fetch they are missing
+// from. Defaults to 24 hours.
+func WithTrustOverlap(overlap time.Duration) Option {
+	return func(rotater *TLSRotater) {
+		rotater.trust.overlap = overlap
+	}
+}
+
+// WithTrustRefreshInterval sets how often the trust bundle is fetched from the
+// Issuer, besides with every new certificate. Defaults to five minutes. The
+// interval has to be positive, or Start fails.
+func WithTrustRefreshInterval(interval time.Duration) Option {
+	return func(rotater *TLSRotater) {
+		rotater.trustInterval = interval
+	}
+}
+
+// WithRevocationPolicy sets when replaced certificates are revoked. Defaults
+// to RevokeImmediately.
+func WithRevocationPolicy(policy RevocationPolicy) Option {
+	return func(rotater *TLSRotater) {
+		rotater.revocationPolicy = policy
+	}
+}
+
+// WithRevocationGrace sets how long a replaced certificate stays valid under
+// RevokeAfterGrace. Defaults to one minute.
+func WithRevocationGrace(grace time.Duration) Option {
+	return func(rotater *TLSRotater) {
+		rotater.revocationGrace = grace
+	}
+}
+
+// WithRevokeOnStop makes the rotater revoke its current certificate, and
+// remove it from the cache, when it is stopped.
+func WithRevokeOnStop(revoke bool) Option {
+	return func(rotater *TLSRotater) {
+		rotater.revokeOnStop = revoke
+	}
+}
+
+// WithTokenSource reports the state of the Vault token kept valid by the
+// given TokenSource in the rotater's Status.
+func WithTokenSource(source *TokenSource) Option {
+	return func(rotater *TLSRotater) {
+		rotater.tokenSource = source
+	}
+}
+
+// WithCache keeps the issued certificate, key, chain and serial in the given
+// directory. On Start, a cached certificate that stays valid for longer than
+// minValidity is used instead of issuing a new one.
+func WithCache(dir string, minValidity time.Duration) Option {
+	return func(rotater *TLSRotater) {
+		rotater.cacheDir = dir
+		rotater.cacheMinValidity = minValidity
+	}
+}
+
+// WithFileSink writes every new certificate through the given FileSink, in
+// the background.
+func WithFileSink(sink *FileSink) Option {
+	return func(rotater *TLSRotater) {
+		rotater.OnRotate(func(event Event) {
+			sink.update(event.Certificate, rotater.trust.PEM())
+		})
+	}
+}
@@ -0,0 +1,98 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// SecurityProfile is a named policy of TLS versions, cipher suites and key
+// exchange curves applied by ServerTLSConfig and ClientTLSConfig.
+type SecurityProfile int
+
+const (
+	// ProfileIntermediate allows TLS 1.2 with forward secret AEAD cipher
+	// suites only, and TLS 1.3.
+	ProfileIntermediate SecurityProfile = iota
+	// ProfileModern allows TLS 1.3 only.
+	ProfileModern
+	// ProfileCompatibility allows TLS 1.0 and later with the cipher suites
+	// Go enables by default, for peers that can't do better.
+	ProfileCompatibility
+)
+
+var securityProfileNames = map[SecurityProfile]string{
+	ProfileIntermediate:  "intermediate",
+	ProfileModern:        "modern",
+	ProfileCompatibility: "compatibility",
+}
+
+func (profile SecurityProfile) String() string {
+	if name, ok := securityProfileNames[profile]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseSecurityProfile parses the name of a security profile: "modern",
+// "intermediate" or "compatibility".
+func ParseSecurityProfile(name string) (SecurityProfile, error) {
+	for profile, profileName := range securityProfileNames {
+		if profileName == name {
+			return profile, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown security profile %q", name)
+}
+
+// curvePreferences prefers the hybrid post-quantum key exchange, falling
+// back to classical curves for peers that don't support it.
+var curvePreferences = []tls.CurveID{
+	tls.X25519MLKEM768,
+	tls.X25519,
+	tls.CurveP256,
+	tls.CurveP384,
+}
+
+// intermediateCipherSuites are the TLS 1.2 cipher suites allowed by
+// ProfileIntermediate. TLS 1.3 suites aren't configurable.
+var intermediateCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// apply sets the versions, cipher suites and curves of the profile on a
+// config.
+func (profile SecurityProfile) apply(config *tls.Config) {
+	config.MaxVersion = tls.VersionTLS13
+	config.CurvePreferences = curvePreferences
+	switch profile {
+	case ProfileModern:
+		config.MinVersion = tls.VersionTLS13
+	case ProfileCompatibility:
+		config.MinVersion = tls.VersionTLS10
+	default:
+		config.MinVersion = tls.VersionTLS12
+		config.CipherSuites = intermediateCipherSuites
+	}
+}
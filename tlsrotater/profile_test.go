@@ -0,0 +1,99 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+// handshake runs a TLS handshake between the configs over an in-memory
+// connection, returning the state seen by the client.
+func handshake(serverConfig, clientConfig *tls.Config) (tls.ConnectionState, error) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	server := tls.Server(serverConn, serverConfig)
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Handshake()
+		// Unblock the client if the server gave up
+		serverConn.Close()
+	}()
+	client := tls.Client(clientConn, clientConfig)
+	err := client.Handshake()
+	if serverErr := <-served; err == nil {
+		err = serverErr
+	}
+	return client.ConnectionState(), err
+}
+
+func TestSecurityProfileHandshake(t *testing.T) {
+	aeadSuites := []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+	cbcSuites := []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA}
+	tests := []struct {
+		name         string
+		profile      SecurityProfile
+		maxVersion   uint16
+		cipherSuites []uint16
+		curves       []tls.CurveID
+		wantErr      bool
+		wantVersion  uint16
+		wantCurve    tls.CurveID
+	}{
+		{"modern with TLS 1.3", ProfileModern, 0, nil, nil, false, tls.VersionTLS13, tls.X25519MLKEM768},
+		{"modern with TLS 1.2", ProfileModern, tls.VersionTLS12, aeadSuites, nil, true, 0, 0},
+		{"intermediate with TLS 1.2 AEAD suite", ProfileIntermediate, tls.VersionTLS12, aeadSuites, nil, false, tls.VersionTLS12, tls.X25519},
+		{"intermediate with TLS 1.2 CBC suite", ProfileIntermediate, tls.VersionTLS12, cbcSuites, nil, true, 0, 0},
+		{"compatibility with TLS 1.2 CBC suite", ProfileCompatibility, tls.VersionTLS12, cbcSuites, nil, false, tls.VersionTLS12, tls.X25519},
+		{"intermediate with TLS 1.3", ProfileIntermediate, 0, nil, nil, false, tls.VersionTLS13, tls.X25519MLKEM768},
+		{"intermediate with classical curves only", ProfileIntermediate, 0, nil, []tls.CurveID{tls.X25519, tls.CurveP256}, false, tls.VersionTLS13, tls.X25519},
+		{"compatibility with TLS 1.3", ProfileCompatibility, 0, nil, nil, false, tls.VersionTLS13, tls.X25519MLKEM768},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, issuer := newTestIssuer(t)
+			server, _ := startTestRotater(t, issuer, WithDNSNames("server.example.org"), WithSecurityProfile(test.profile))
+			client, _ := startTestRotater(t, issuer, WithSecurityProfile(ProfileCompatibility))
+			config := client.ClientTLSConfig()
+			config.ServerName = "server.example.org"
+			if test.maxVersion != 0 {
+				config.MaxVersion = test.maxVersion
+			}
+			config.CipherSuites = test.cipherSuites
+			if test.curves != nil {
+				config.CurvePreferences = test.curves
+			}
+
+			state, err := handshake(server.ServerTLSConfig(), config)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Handshake returned %v, want error %v", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			if state.Version != test.wantVersion {
+				t.Errorf("Negotiated %v, want %v", tls.VersionName(state.Version), tls.VersionName(test.wantVersion))
+			}
+			if state.CurveID != test.wantCurve {
+				t.Errorf("Negotiated key exchange %v, want %v", state.CurveID, test.wantCurve)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// RevocationPolicy decides when a certificate that has been replaced by a
+// refresh is revoked.
+type RevocationPolicy int
+
+const (
+	// RevokeImmediately revokes the previous certificate as soon as its
+	// replacement has been issued.
+	RevokeImmediately RevocationPolicy = iota
+	// RevokeAfterGrace revokes the previous certificate once the revocation
+	// grace period has passed, leaving in-flight connections and peers that
+	// cached it time to move on.
+	RevokeAfterGrace
+	// RevokeAtExpiry never revokes; the previous certificate simply expires.
+	RevokeAtExpiry
+	// RevokeOnShutdown revokes previous certificates when the rotater is
+	// stopped.
+	RevokeOnShutdown
+)
+
+var revocationPolicyNames = map[RevocationPolicy]string{
+	RevokeImmediately: "immediately",
+	RevokeAfterGrace:  "grace",
+	RevokeAtExpiry:    "expiry",
+	RevokeOnShutdown:  "shutdown",
+}
+
+func (policy RevocationPolicy) String() string {
+	if name, ok := revocationPolicyNames[policy]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseRevocationPolicy parses the name of a revocation policy: "immediately",
+// "grace", "expiry" or "shutdown".
+func ParseRevocationPolicy(name string) (RevocationPolicy, error) {
+	for policy, policyName := range revocationPolicyNames {
+		if policyName == name {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown revocation policy %q", name)
+}
+
+// revocationInterval is how often pending revocations are checked.
+const revocationInterval = 5 * time.Second
+
+// pendingRevocation is a replaced certificate waiting to be revoked.
+type pendingRevocation struct {
+	serial   string
+	notAfter time.Time
+	// due is when to revoke. Zero means on shutdown.
+	due      time.Time
+	failures int
+	// revoking is set while the revocation is in flight.
+	revoking bool
+}
+
+// scheduleRevocation queues the replaced certificate according to the
+// revocation policy.
+func (rotater *TLSRotater) scheduleRevocation(certificate *Certificate) {
+	pending := &pendingRevocation{
+		serial:   certificate.Serial,
+		notAfter: certificate.Keypair.Leaf.NotAfter,
+	}
+	switch rotater.revocationPolicy {
+	case RevokeImmediately:
+		pending.due = time.Now()
+	case RevokeAfterGrace:
+		pending.due = time.Now().Add(rotater.revocationGrace)
+	case RevokeAtExpiry:
+		return
+	}
+	rotater.revocationMu.Lock()
+	rotater.pendingRevocations = append(rotater.pendingRevocations, pending)
+	rotater.revocationMu.Unlock()
+}
+
+// revokeDue revokes the pending certificates that are due, or all of them if
+// flush is set. Certificates that could not be revoked are retried with
+// backoff; those that have expired in the meantime are dropped. The backlog
+// isn't locked while waiting for the Issuer.
+func (rotater *TLSRotater) revokeDue(flush bool) {
+	rotater.revocationMu.Lock()
+	now := time.Now()
+	var due, remaining []*pendingRevocation
+	for _, pending := range rotater.pendingRevocations {
+		if now.After(pending.notAfter) {
+			continue
+		}
+		remaining = append(remaining, pending)
+		if pending.revoking || (!flush && (pending.due.IsZero() || now.Before(pending.due))) {
+			continue
+		}
+		pending.revoking = true
+		due = append(due, pending)
+	}
+	rotater.pendingRevocations = remaining
+	rotater.revocationMu.Unlock()
+	if len(due) == 0 {
+		return
+	}
+
+	errs := make(map[*pendingRevocation]error, len(due))
+	for _, pending := range due {
+		errs[pending] = rotater.issuer.Revoke(pending.serial)
+	}
+
+	var failed []Event
+	rotater.revocationMu.Lock()
+	now = time.Now()
+	remaining = nil
+	for _, pending := range rotater.pendingRevocations {
+		err, attempted := errs[pending]
+		if !attempted {
+			remaining = append(remaining, pending)
+			continue
+		}
+		pending.revoking = false
+		if err == nil {
+			continue
+		}
+		pending.failures++
+		if !pending.due.IsZero() {
+			pending.due = now.Add(rotater.backoff.delay(pending.failures))
+		}
+		fmt.Fprintf(os.Stderr, "Error while revoking certificate %v (attempt %d): %v\n", pending.serial, pending.failures, err)
+		failed = append(failed, Event{
+			Type:      EventRevocationFailed,
+			OldSerial: pending.serial,
+			Err:       err,
+			Reason:    ReasonRevoke,
+			Failures:  pending.failures,
+		})
+		remaining = append(remaining, pending)
+	}
+	rotater.pendingRevocations = remaining
+	rotater.revocationMu.Unlock()
+	for _, event := range failed {
+		rotater.emit(event)
+	}
+}
+
+// PendingRevocations returns the number of replaced certificates still
+// waiting to be revoked.
+func (rotater *TLSRotater) PendingRevocations() int {
+	rotater.revocationMu.Lock()
+	defer rotater.revocationMu.Unlock()
+	return len(rotater.pendingRevocations)
+}
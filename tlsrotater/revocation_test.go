@@ -0,0 +1,186 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sirlatrom/tls-sidecar-playground/tlsrotater/vaulttest"
+)
+
+func TestRevocationPolicies(t *testing.T) {
+	tests := []struct {
+		policy              RevocationPolicy
+		revokedAfterRefresh bool
+		pendingAfterRefresh int
+		revokedAfterStop    bool
+	}{
+		{RevokeImmediately, true, 0, true},
+		{RevokeAfterGrace, false, 1, true},
+		{RevokeAtExpiry, false, 0, false},
+		{RevokeOnShutdown, false, 1, true},
+	}
+	for _, test := range tests {
+		t.Run(test.policy.String(), func(t *testing.T) {
+			server, issuer := newTestIssuer(t)
+			rotater, events := startTestRotater(t, issuer, WithRevocationPolicy(test.policy), WithRevocationGrace(time.Hour))
+			serial := nextEvent(t, events, EventRotated).NewSerial
+			if err := rotater.refresh(); err != nil {
+				t.Fatal(err)
+			}
+			if revoked := server.Revoked(serial); revoked != test.revokedAfterRefresh {
+				t.Errorf("Replaced certificate revoked after refresh: %v, want %v", revoked, test.revokedAfterRefresh)
+			}
+			if pending := rotater.PendingRevocations(); pending != test.pendingAfterRefresh {
+				t.Errorf("%d revocations pending after refresh, want %d", pending, test.pendingAfterRefresh)
+			}
+			rotater.Stop()
+			if revoked := server.Revoked(serial); revoked != test.revokedAfterStop {
+				t.Errorf("Replaced certificate revoked after stop: %v, want %v", revoked, test.revokedAfterStop)
+			}
+			if pending := rotater.PendingRevocations(); pending != 0 {
+				t.Errorf("%d revocations pending after stop, want none", pending)
+			}
+			if current := rotater.Status().Serial; server.Revoked(current) {
+				t.Errorf("Current certificate %v was revoked", current)
+			}
+		})
+	}
+}
+
+func TestRevokeOnStop(t *testing.T) {
+	server, issuer := newTestIssuer(t)
+	rotater, _ := startTestRotater(t, issuer, WithRevokeOnStop(true))
+	serial := rotater.Status().Serial
+	rotater.Stop()
+	if !server.Revoked(serial) {
+		t.Errorf("Current certificate %v wasn't revoked on stop", serial)
+	}
+}
+
+// makeRevocationsDue makes the pending revocations scheduled for later due
+// now, reporting whether any were.
+func makeRevocationsDue(rotater *TLSRotater) bool {
+	rotater.revocationMu.Lock()
+	defer rotater.revocationMu.Unlock()
+	now := time.Now()
+	scheduled := false
+	for _, pending := range rotater.pendingRevocations {
+		if pending.due.After(now) {
+			pending.due = now
+			scheduled = true
+		}
+	}
+	return scheduled
+}
+
+func TestRevocationRetried(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy RevocationPolicy
+		fault  vaulttest.Fault
+	}{
+		{"immediately failing", RevokeImmediately, vaulttest.Fault{Status: http.StatusServiceUnavailable}},
+		{"immediately malformed", RevokeImmediately, vaulttest.Fault{Malformed: true}},
+		{"after grace failing", RevokeAfterGrace, vaulttest.Fault{Status: http.StatusInternalServerError}},
+		{"on shutdown failing", RevokeOnShutdown, vaulttest.Fault{Status: http.StatusServiceUnavailable}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, issuer := newTestIssuer(t)
+			rotater, events := startTestRotater(t, issuer, WithRevocationPolicy(test.policy), WithRevocationGrace(0))
+			serial := nextEvent(t, events, EventRotated).NewSerial
+			server.Inject(vaulttest.EndpointRevoke, test.fault)
+			if err := rotater.refresh(); err != nil {
+				t.Fatal(err)
+			}
+			// Revocations on shutdown are only attempted when flushed, the
+			// others have already been attempted once by the refresh
+			flush := test.policy == RevokeOnShutdown
+			retry := func() {
+				backedOff := makeRevocationsDue(rotater)
+				if !flush && !backedOff {
+					t.Error("Failed revocation wasn't scheduled for a later retry")
+				}
+				rotater.revokeDue(flush)
+			}
+			if flush {
+				retry()
+			}
+			retry()
+			for failures := 1; failures <= 2; failures++ {
+				event := nextEvent(t, events, EventRevocationFailed)
+				if event.OldSerial != serial || event.Reason != ReasonRevoke || event.Failures != failures {
+					t.Errorf("Got revocation failure of %v for %v after %d failures, want %v for %v after %d", event.OldSerial, event.Reason, event.Failures, serial, ReasonRevoke, failures)
+				}
+			}
+			if server.Revoked(serial) {
+				t.Fatalf("Replaced certificate %v revoked while the revoke endpoint fails", serial)
+			}
+			if pending := rotater.PendingRevocations(); pending != 1 {
+				t.Errorf("%d revocations pending while the revoke endpoint fails, want 1", pending)
+			}
+
+			server.ClearFaults()
+			retry()
+			if !server.Revoked(serial) {
+				t.Errorf("Replaced certificate %v wasn't revoked once the revoke endpoint recovered", serial)
+			}
+			if pending := rotater.PendingRevocations(); pending != 0 {
+				t.Errorf("%d revocations pending after recovery, want none", pending)
+			}
+		})
+	}
+}
+
+func TestPendingRevocationsWhileRevoking(t *testing.T) {
+	server, issuer := newTestIssuer(t)
+	rotater, _ := startTestRotater(t, issuer, WithRevocationPolicy(RevokeOnShutdown))
+	if err := rotater.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	latency := time.Second
+	server.Inject(vaulttest.EndpointRevoke, vaulttest.Fault{Latency: latency})
+	flushed := make(chan struct{})
+	go func() {
+		defer close(flushed)
+		rotater.revokeDue(true)
+	}()
+	for server.Requests(vaulttest.EndpointRevoke) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	started := time.Now()
+	if pending := rotater.PendingRevocations(); pending != 1 {
+		t.Errorf("%d revocations pending while revoking, want 1", pending)
+	}
+	if waited := time.Since(started); waited > latency/2 {
+		t.Errorf("PendingRevocations waited %v for the revocation in flight", waited)
+	}
+	// A revocation in flight isn't attempted again
+	rotater.revokeDue(true)
+	<-flushed
+	if requests := server.Requests(vaulttest.EndpointRevoke); requests != 1 {
+		t.Errorf("%d revoke requests, want 1", requests)
+	}
+	if pending := rotater.PendingRevocations(); pending != 0 {
+		t.Errorf("%d revocations pending after revoking, want none", pending)
+	}
+}
@@ -0,0 +1,189 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileSink writes the rotated identity to files, for applications that are
+// not linked against tlsrotater, and tells them to reload.
+//
+// Every file is written to a temporary file and renamed into place, so
+// readers never see a partially written certificate or key. Files are written
+// and the application told to reload in the background, so that a slow reload
+// doesn't hold up renewals; rotations made meanwhile are written once it is
+// done, skipping all but the latest.
+type FileSink struct {
+	// Dir is the directory to write cert.pem, key.pem and ca.pem into.
+	Dir string
+	// Signal is sent to the process in PID, or the one whose PID is read
+	// from PIDFile, after writing the files.
+	Signal  os.Signal
+	PID     int
+	PIDFile string
+	// Command is run after writing the files, and killed if it takes longer
+	// than CommandTimeout. CommandTimeout defaults to 30 seconds.
+	Command        []string
+	CommandTimeout time.Duration
+
+	mu      sync.Mutex
+	next    *sinkUpdate
+	writing bool
+	idle    *sync.Cond
+}
+
+// sinkUpdate is a rotation waiting to be written by a FileSink.
+type sinkUpdate struct {
+	certificate *Certificate
+	trustBundle []byte
+}
+
+// defaultCommandTimeout is how long the reload command of a FileSink may run
+// by default.
+const defaultCommandTimeout = 30 * time.Second
+
+// Names of the files written by a FileSink.
+const (
+	SinkCertFile = "cert.pem"
+	SinkKeyFile  = "key.pem"
+	SinkCAFile   = "ca.pem"
+)
+
+// update writes the certificate and trust bundle, and triggers the reload, in
+// the background.
+func (sink *FileSink) update(certificate *Certificate, trustBundle []byte) {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	sink.next = &sinkUpdate{certificate: certificate, trustBundle: trustBundle}
+	if sink.writing {
+		return
+	}
+	sink.writing = true
+	go sink.drain()
+}
+
+// drain writes updates until there are no more.
+func (sink *FileSink) drain() {
+	for {
+		sink.mu.Lock()
+		next := sink.next
+		sink.next = nil
+		if next == nil {
+			sink.writing = false
+			if sink.idle != nil {
+				sink.idle.Broadcast()
+			}
+			sink.mu.Unlock()
+			return
+		}
+		sink.mu.Unlock()
+		if err := sink.write(next.certificate, next.trustBundle); err != nil {
+			fmt.Fprintf(os.Stderr, "Error while writing certificate to %v: %v\n", sink.Dir, err)
+		}
+	}
+}
+
+// Wait waits until the latest rotation has been written and the application
+// told to reload.
+func (sink *FileSink) Wait() {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.idle == nil {
+		sink.idle = sync.NewCond(&sink.mu)
+	}
+	for sink.writing {
+		sink.idle.Wait()
+	}
+}
+
+// write writes the certificate and trust bundle and triggers the reload.
+func (sink *FileSink) write(certificate *Certificate, trustBundle []byte) error {
+	certPEM, keyPEM, err := encodeKeypair(certificate.Keypair)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(sink.Dir, 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(sink.Dir, SinkCertFile), certPEM, 0644); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(sink.Dir, SinkKeyFile), keyPEM, 0600); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(sink.Dir, SinkCAFile), trustBundle, 0644); err != nil {
+		return err
+	}
+	log.Printf("Wrote certificate %v to %v\n", certificate.Serial, sink.Dir)
+	return sink.reload()
+}
+
+// reload signals the process and runs the command, if configured.
+func (sink *FileSink) reload() error {
+	if sink.Signal != nil && (sink.PID != 0 || sink.PIDFile != "") {
+		pid := sink.PID
+		if sink.PIDFile != "" {
+			contents, err := ioutil.ReadFile(sink.PIDFile)
+			if err != nil {
+				return err
+			}
+			if pid, err = strconv.Atoi(strings.TrimSpace(string(contents))); err != nil {
+				return fmt.Errorf("Invalid PID in %v: %v", sink.PIDFile, err)
+			}
+		}
+		process, err := os.FindProcess(pid)
+		if err != nil {
+			return err
+		}
+		if err := process.Signal(sink.Signal); err != nil {
+			return fmt.Errorf("Couldn't signal %d: %v", pid, err)
+		}
+		log.Printf("Sent %v to %d\n", sink.Signal, pid)
+	}
+	if len(sink.Command) > 0 {
+		timeout := sink.CommandTimeout
+		if timeout <= 0 {
+			timeout = defaultCommandTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		command := exec.CommandContext(ctx, sink.Command[0], sink.Command[1:]...)
+		// Don't wait for children of a killed command still holding its output
+		command.WaitDelay = time.Second
+		output, err := command.CombinedOutput()
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("Reload command timed out after %v: %s", timeout, output)
+		}
+		if err != nil {
+			return fmt.Errorf("Reload command failed: %v: %s", err, output)
+		}
+		log.Printf("Ran reload command %v\n", sink.Command)
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// readSinkCert returns the serial number of the certificate in a sink
+// directory.
+func readSinkCert(t *testing.T, dir string) *big.Int {
+	t.Helper()
+	contents, err := ioutil.ReadFile(filepath.Join(dir, SinkCertFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		t.Fatalf("No PEM block in %v", SinkCertFile)
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.SerialNumber
+}
+
+func TestFileSinkWrite(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	if err := ioutil.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		sink       *FileSink
+		wantSignal bool
+		wantRun    bool
+		wantErr    string
+	}{
+		{"no reload", &FileSink{}, false, false, ""},
+		{"signal", &FileSink{Signal: syscall.SIGUSR1, PID: os.Getpid()}, true, false, ""},
+		{"signal by PID file", &FileSink{Signal: syscall.SIGUSR1, PIDFile: pidFile}, true, false, ""},
+		{"command", &FileSink{Command: []string{"touch"}}, false, true, ""},
+		{"command failing", &FileSink{Command: []string{"false"}}, false, false, "Reload command failed"},
+		{"command timing out", &FileSink{Command: []string{"sleep", "10"}, CommandTimeout: 100 * time.Millisecond}, false, false, "timed out"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, issuer := newTestIssuer(t)
+			rotater, _ := startTestRotater(t, issuer)
+			sink := test.sink
+			sink.Dir = filepath.Join(t.TempDir(), "certs")
+			ran := filepath.Join(t.TempDir(), "ran")
+			if len(sink.Command) == 1 && sink.Command[0] == "touch" {
+				sink.Command = append(sink.Command, ran)
+			}
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGUSR1)
+			defer signal.Stop(signals)
+
+			certificate := rotater.current.Load()
+			started := time.Now()
+			err := sink.write(certificate, rotater.trust.PEM())
+			if test.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Fatalf("Write returned %v, want an error containing %q", err, test.wantErr)
+			}
+			if elapsed := time.Since(started); elapsed > 5*time.Second {
+				t.Errorf("Write took %v", elapsed)
+			}
+
+			if serial, want := readSinkCert(t, sink.Dir), certificate.Keypair.Leaf.SerialNumber; serial.Cmp(want) != 0 {
+				t.Errorf("Wrote certificate %v, want %v", serial, want)
+			}
+			entries, err := ioutil.ReadDir(sink.Dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			modes := make(map[string]os.FileMode)
+			for _, entry := range entries {
+				modes[entry.Name()] = entry.Mode().Perm()
+			}
+			wantModes := map[string]os.FileMode{SinkCertFile: 0644, SinkKeyFile: 0600, SinkCAFile: 0644}
+			if len(modes) != len(wantModes) {
+				t.Errorf("Sink directory holds %v, want only %v", modes, wantModes)
+			}
+			for name, want := range wantModes {
+				if modes[name] != want {
+					t.Errorf("%v has mode %v, want %v", name, modes[name], want)
+				}
+			}
+
+			select {
+			case <-signals:
+				if !test.wantSignal {
+					t.Error("Signalled without a reload signal")
+				}
+			case <-time.After(100 * time.Millisecond):
+				if test.wantSignal {
+					t.Error("Wasn't signalled")
+				}
+			}
+			if _, err := os.Stat(ran); (err == nil) != test.wantRun {
+				t.Errorf("Command ran: %v, want %v", err == nil, test.wantRun)
+			}
+		})
+	}
+}
+
+func TestFileSinkReplacesAtomically(t *testing.T) {
+	_, issuer := newTestIssuer(t)
+	rotater, _ := startTestRotater(t, issuer)
+	sink := &FileSink{Dir: t.TempDir()}
+	first := rotater.current.Load()
+	if err := sink.write(first, rotater.trust.PEM()); err != nil {
+		t.Fatal(err)
+	}
+	// A reader that opened the files before they are replaced keeps reading
+	// the complete old ones
+	reader, err := os.Open(filepath.Join(sink.Dir, SinkCertFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if err := rotater.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	second := rotater.current.Load()
+	if err := sink.write(second, rotater.trust.PEM()); err != nil {
+		t.Fatal(err)
+	}
+	old, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldPEM, _, err := encodeKeypair(first.Keypair)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(old) != string(oldPEM) {
+		t.Error("The open certificate file was changed in place")
+	}
+	if serial, want := readSinkCert(t, sink.Dir), second.Keypair.Leaf.SerialNumber; serial.Cmp(want) != 0 {
+		t.Errorf("Wrote certificate %v, want %v", serial, want)
+	}
+}
+
+func TestFileSinkReloadOffRefreshPath(t *testing.T) {
+	sink := &FileSink{
+		Dir:            t.TempDir(),
+		Command:        []string{"sleep", "10"},
+		CommandTimeout: 500 * time.Millisecond,
+	}
+	_, issuer := newTestIssuer(t)
+	rotater, _ := startTestRotater(t, issuer, WithFileSink(sink))
+	for i := 0; i < 3; i++ {
+		started := time.Now()
+		if err := rotater.refresh(); err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(started); elapsed > 250*time.Millisecond {
+			t.Errorf("Refresh waited %v for the reload command", elapsed)
+		}
+	}
+	sink.Wait()
+	if serial, want := readSinkCert(t, sink.Dir), rotater.current.Load().Keypair.Leaf.SerialNumber; serial.Cmp(want) != 0 {
+		t.Errorf("Wrote certificate %v, want the latest %v", serial, want)
+	}
+}
@@ -0,0 +1,183 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// SPIFFEID is a SPIFFE ID, such as spiffe://example.org/dumbserver.
+type SPIFFEID struct {
+	TrustDomain string
+	// Path is the path of the workload within the trust domain, starting
+	// with a slash.
+	Path string
+}
+
+// ParseSPIFFEID parses a SPIFFE ID.
+func ParseSPIFFEID(id string) (SPIFFEID, error) {
+	uri, err := url.Parse(id)
+	if err != nil {
+		return SPIFFEID{}, fmt.Errorf("Invalid SPIFFE ID %q: %v", id, err)
+	}
+	return spiffeIDFromURL(uri)
+}
+
+// spiffeIDFromURL checks that a URI is a SPIFFE ID of a workload.
+func spiffeIDFromURL(uri *url.URL) (SPIFFEID, error) {
+	switch {
+	case uri.Scheme != "spiffe":
+		return SPIFFEID{}, fmt.Errorf("SPIFFE ID %q doesn't have the spiffe scheme", uri)
+	case uri.Host == "" || uri.Host != strings.ToLower(uri.Host) || uri.Port() != "":
+		return SPIFFEID{}, fmt.Errorf("SPIFFE ID %q doesn't have a valid trust domain", uri)
+	case uri.User != nil || uri.RawQuery != "" || uri.Fragment != "":
+		return SPIFFEID{}, fmt.Errorf("SPIFFE ID %q has user info, a query or a fragment", uri)
+	case uri.Path == "" || uri.Path == "/" || strings.HasSuffix(uri.Path, "/") || strings.Contains(uri.Path, "//"):
+		return SPIFFEID{}, fmt.Errorf("SPIFFE ID %q doesn't have a valid workload path", uri)
+	}
+	return SPIFFEID{TrustDomain: uri.Host, Path: uri.Path}, nil
+}
+
+// URL returns the SPIFFE ID as a URI SAN.
+func (id SPIFFEID) URL() *url.URL {
+	return &url.URL{Scheme: "spiffe", Host: id.TrustDomain, Path: id.Path}
+}
+
+func (id SPIFFEID) String() string {
+	return id.URL().String()
+}
+
+// PeerSPIFFEID returns the SPIFFE ID of a certificate, which has to have
+// exactly one spiffe URI SAN.
+func PeerSPIFFEID(certificate *x509.Certificate) (SPIFFEID, error) {
+	var ids []*url.URL
+	for _, uri := range certificate.URIs {
+		if uri.Scheme == "spiffe" {
+			ids = append(ids, uri)
+		}
+	}
+	if len(ids) != 1 {
+		return SPIFFEID{}, fmt.Errorf("Certificate %v has %d SPIFFE IDs", certificate.Subject.CommonName, len(ids))
+	}
+	return spiffeIDFromURL(ids[0])
+}
+
+// SPIFFEMatcher decides whether a peer with the given SPIFFE ID is accepted.
+type SPIFFEMatcher func(id SPIFFEID) error
+
+// MatchSPIFFEID accepts peers with any of the given SPIFFE IDs.
+func MatchSPIFFEID(ids ...SPIFFEID) SPIFFEMatcher {
+	return func(id SPIFFEID) error {
+		for _, allowed := range ids {
+			if id == allowed {
+				return nil
+			}
+		}
+		return fmt.Errorf("Unexpected SPIFFE ID %v", id)
+	}
+}
+
+// MatchTrustDomain accepts peers with any SPIFFE ID in the trust domain.
+func MatchTrustDomain(trustDomain string) SPIFFEMatcher {
+	return func(id SPIFFEID) error {
+		if id.TrustDomain != trustDomain {
+			return fmt.Errorf("SPIFFE ID %v isn't in trust domain %v", id, trustDomain)
+		}
+		return nil
+	}
+}
+
+// matchPeer accepts a peer whose certificate has a SPIFFE ID accepted by
+// match.
+func matchPeer(state tls.ConnectionState, match SPIFFEMatcher) error {
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("Peer presented no certificate")
+	}
+	id, err := PeerSPIFFEID(state.PeerCertificates[0])
+	if err != nil {
+		return err
+	}
+	return match(id)
+}
+
+// SPIFFEServerTLSConfig is like ServerTLSConfig, but also requires clients to
+// have a SPIFFE ID accepted by match.
+func (identities *Identities) SPIFFEServerTLSConfig(match SPIFFEMatcher) *tls.Config {
+	config := identities.ServerTLSConfig()
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if err := identities.verifyPeer(state, x509.ExtKeyUsageClientAuth, ""); err != nil {
+			return err
+		}
+		return matchPeer(state, match)
+	}
+	return config
+}
+
+// SPIFFEClientTLSConfig is like ClientTLSConfig, but accepts servers by their
+// SPIFFE ID, as decided by match, rather than by host name.
+func (identities *Identities) SPIFFEClientTLSConfig(match SPIFFEMatcher) *tls.Config {
+	config := identities.ClientTLSConfig()
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if err := identities.verifyPeer(state, x509.ExtKeyUsageServerAuth, ""); err != nil {
+			return err
+		}
+		return matchPeer(state, match)
+	}
+	return config
+}
+
+// SPIFFEServerTLSConfig is like ServerTLSConfig, but also requires clients to
+// have a SPIFFE ID accepted by match.
+func (rotater *TLSRotater) SPIFFEServerTLSConfig(match SPIFFEMatcher) *tls.Config {
+	return NewIdentities(rotater).SPIFFEServerTLSConfig(match)
+}
+
+// SPIFFEClientTLSConfig is like ClientTLSConfig, but accepts servers by their
+// SPIFFE ID, as decided by match, rather than by host name.
+func (rotater *TLSRotater) SPIFFEClientTLSConfig(match SPIFFEMatcher) *tls.Config {
+	return NewIdentities(rotater).SPIFFEClientTLSConfig(match)
+}
+
+// spiffeIDKey is the context key of the SPIFFE ID of the peer.
+type spiffeIDKey struct{}
+
+// SPIFFEHandler returns a handler that adds the SPIFFE ID of the client, if
+// it has one, to the context of requests before serving them with next.
+func SPIFFEHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			if id, err := PeerSPIFFEID(r.TLS.PeerCertificates[0]); err == nil {
+				r = r.WithContext(context.WithValue(r.Context(), spiffeIDKey{}, id))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SPIFFEIDFromContext returns the SPIFFE ID of the client added by
+// SPIFFEHandler, if any.
+func SPIFFEIDFromContext(ctx context.Context) (SPIFFEID, bool) {
+	id, ok := ctx.Value(spiffeIDKey{}).(SPIFFEID)
+	return id, ok
+}
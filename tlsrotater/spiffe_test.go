@@ -0,0 +1,206 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestParseSPIFFEID(t *testing.T) {
+	tests := []struct {
+		id      string
+		want    SPIFFEID
+		wantErr bool
+	}{
+		{"spiffe://example.org/dumbserver", SPIFFEID{"example.org", "/dumbserver"}, false},
+		{"spiffe://example.org/ns/prod/dumbserver", SPIFFEID{"example.org", "/ns/prod/dumbserver"}, false},
+		{"https://example.org/dumbserver", SPIFFEID{}, true},
+		{"spiffe:///dumbserver", SPIFFEID{}, true},
+		{"spiffe://Example.org/dumbserver", SPIFFEID{}, true},
+		{"spiffe://example.org:8443/dumbserver", SPIFFEID{}, true},
+		{"spiffe://user@example.org/dumbserver", SPIFFEID{}, true},
+		{"spiffe://example.org/dumbserver?version=2", SPIFFEID{}, true},
+		{"spiffe://example.org/dumbserver#main", SPIFFEID{}, true},
+		{"spiffe://example.org", SPIFFEID{}, true},
+		{"spiffe://example.org/", SPIFFEID{}, true},
+		{"spiffe://example.org/dumbserver/", SPIFFEID{}, true},
+		{"spiffe://example.org/ns//dumbserver", SPIFFEID{}, true},
+		{"spiffe://example.org/%zz", SPIFFEID{}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.id, func(t *testing.T) {
+			id, err := ParseSPIFFEID(test.id)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseSPIFFEID returned %v, want error %v", err, test.wantErr)
+			}
+			if id != test.want {
+				t.Errorf("ParseSPIFFEID returned %+v, want %+v", id, test.want)
+			}
+			if !test.wantErr && id.String() != test.id {
+				t.Errorf("SPIFFE ID formats as %v, want %v", id, test.id)
+			}
+		})
+	}
+}
+
+func mustParseSPIFFEID(t *testing.T, id string) SPIFFEID {
+	t.Helper()
+	parsed, err := ParseSPIFFEID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestSPIFFEClientTLSConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		serverID string
+		match    func(t *testing.T) SPIFFEMatcher
+		wantErr  bool
+	}{
+		{"expected ID", "spiffe://example.org/dumbserver", func(t *testing.T) SPIFFEMatcher {
+			return MatchSPIFFEID(mustParseSPIFFEID(t, "spiffe://example.org/dumbserver"))
+		}, false},
+		{"one of the expected IDs", "spiffe://example.org/dumbserver", func(t *testing.T) SPIFFEMatcher {
+			return MatchSPIFFEID(mustParseSPIFFEID(t, "spiffe://example.org/other"), mustParseSPIFFEID(t, "spiffe://example.org/dumbserver"))
+		}, false},
+		{"wrong ID", "spiffe://example.org/impostor", func(t *testing.T) SPIFFEMatcher {
+			return MatchSPIFFEID(mustParseSPIFFEID(t, "spiffe://example.org/dumbserver"))
+		}, true},
+		{"ID in trust domain", "spiffe://example.org/dumbserver", func(t *testing.T) SPIFFEMatcher {
+			return MatchTrustDomain("example.org")
+		}, false},
+		{"ID in other trust domain", "spiffe://example.com/dumbserver", func(t *testing.T) SPIFFEMatcher {
+			return MatchTrustDomain("example.org")
+		}, true},
+		{"no ID", "", func(t *testing.T) SPIFFEMatcher {
+			return MatchTrustDomain("example.org")
+		}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, issuer := newTestIssuer(t)
+			var serverOptions []Option
+			if test.serverID != "" {
+				serverOptions = append(serverOptions, WithSPIFFEID(mustParseSPIFFEID(t, test.serverID)))
+			}
+			server, _ := startTestRotater(t, issuer, serverOptions...)
+			client, _ := startTestRotater(t, issuer)
+			served := 0
+			backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				served++
+			}))
+			backend.TLS = server.ServerTLSConfig()
+			backend.StartTLS()
+			defer backend.Close()
+
+			// The server certificate isn't valid for the host dialled, which
+			// doesn't matter when accepting it by its SPIFFE ID
+			transport := &http.Transport{TLSClientConfig: client.SPIFFEClientTLSConfig(test.match(t))}
+			response, err := (&http.Client{Transport: transport}).Get(backend.URL)
+			if err == nil {
+				response.Body.Close()
+			}
+			if (err != nil) != test.wantErr {
+				t.Errorf("Request returned %v, want error %v", err, test.wantErr)
+			}
+			if test.wantErr && served > 0 {
+				t.Error("Server not accepted received the request")
+			}
+		})
+	}
+}
+
+func TestSPIFFEHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		clientID string
+		want     string
+	}{
+		{"client with ID", "spiffe://example.org/outproxy", "spiffe://example.org/outproxy"},
+		{"client without ID", "", "none"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, issuer := newTestIssuer(t)
+			server, _ := startTestRotater(t, issuer, WithDNSNames("server.example.org"))
+			var clientOptions []Option
+			if test.clientID != "" {
+				clientOptions = append(clientOptions, WithSPIFFEID(mustParseSPIFFEID(t, test.clientID)))
+			}
+			client, _ := startTestRotater(t, issuer, clientOptions...)
+			backend := httptest.NewUnstartedServer(SPIFFEHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if id, ok := SPIFFEIDFromContext(r.Context()); ok {
+					fmt.Fprint(w, id)
+				} else {
+					fmt.Fprint(w, "none")
+				}
+			})))
+			backend.TLS = server.ServerTLSConfig()
+			backend.StartTLS()
+			defer backend.Close()
+
+			config := client.ClientTLSConfig()
+			config.ServerName = "server.example.org"
+			response, err := (&http.Client{Transport: &http.Transport{TLSClientConfig: config}}).Get(backend.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+			body, err := ioutil.ReadAll(response.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != test.want {
+				t.Errorf("Handler saw SPIFFE ID %q, want %q", body, test.want)
+			}
+		})
+	}
+}
+
+func TestSPIFFEHandlerWithoutTLS(t *testing.T) {
+	handler := SPIFFEHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := SPIFFEIDFromContext(r.Context()); ok {
+			t.Errorf("Handler saw SPIFFE ID %v", id)
+		}
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
+
+func TestWithSPIFFEIDKeepsURIs(t *testing.T) {
+	_, issuer := newTestIssuer(t)
+	uris := make([]*url.URL, 1, 2)
+	uris[0] = &url.URL{Scheme: "https", Host: "example.org"}
+	first := NewTLSRotater(issuer, "first", WithURIs(uris...), WithSPIFFEID(mustParseSPIFFEID(t, "spiffe://example.org/first")))
+	second := NewTLSRotater(issuer, "second", WithURIs(uris...), WithSPIFFEID(mustParseSPIFFEID(t, "spiffe://example.org/second")))
+	for _, rotater := range []*TLSRotater{first, second} {
+		want := "spiffe://example.org/" + rotater.request.CommonName
+		if got := rotater.request.URIs; len(got) != 2 || got[0] != uris[0] || got[1].String() != want {
+			t.Errorf("Rotater %v requests URIs %v, want %v and %v", rotater.request.CommonName, got, uris[0], want)
+		}
+	}
+	if len(uris) != 1 {
+		t.Errorf("URIs given to WithURIs changed to %v", uris)
+	}
+}
@@ -0,0 +1,132 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"time"
+)
+
+// State describes the health of a TLSRotater.
+type State int
+
+const (
+	// StateStarting means no certificate has been issued yet.
+	StateStarting State = iota
+	// StateHealthy means the last refresh succeeded.
+	StateHealthy
+	// StateDegraded means refreshing is failing, but the current certificate
+	// is still valid and being served.
+	StateDegraded
+	// StateFailed means the current certificate has expired, or none could
+	// be issued at all.
+	StateFailed
+)
+
+func (state State) String() string {
+	switch state {
+	case StateStarting:
+		return "starting"
+	case StateHealthy:
+		return "healthy"
+	case StateDegraded:
+		return "degraded"
+	case StateFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// Status is a snapshot of the health of a TLSRotater.
+type Status struct {
+	State State
+	// Serial and NotAfter describe the certificate currently served.
+	Serial   string
+	NotAfter time.Time
+	// LastRefresh is when a certificate was last issued.
+	LastRefresh time.Time
+	// LastError is the error of the latest refresh, if it failed.
+	LastError error
+	// Failures is the number of consecutive failed refreshes.
+	Failures int
+	// Token is the status of the Vault token, if a TokenSource was given.
+	Token *TokenStatus
+}
+
+// Status returns the current health of the rotater.
+func (rotater *TLSRotater) Status() Status {
+	rotater.statusMu.Lock()
+	status := Status{
+		LastRefresh: rotater.lastRefresh,
+		LastError:   rotater.lastError,
+		Failures:    rotater.failures,
+	}
+	rotater.statusMu.Unlock()
+
+	certificate := rotater.current.Load()
+	switch {
+	case certificate == nil && status.Failures == 0:
+		status.State = StateStarting
+	case certificate == nil:
+		status.State = StateFailed
+	case time.Now().After(certificate.Keypair.Leaf.NotAfter):
+		status.State = StateFailed
+	case status.LastError != nil:
+		status.State = StateDegraded
+	default:
+		status.State = StateHealthy
+	}
+	if certificate != nil {
+		status.Serial = certificate.Serial
+		status.NotAfter = certificate.Keypair.Leaf.NotAfter
+	}
+	if rotater.tokenSource != nil {
+		tokenStatus := rotater.tokenSource.Status()
+		status.Token = &tokenStatus
+	}
+	return status
+}
+
+// State returns the current state of the rotater.
+func (rotater *TLSRotater) State() State {
+	return rotater.Status().State
+}
+
+// recordRefresh updates the status with the outcome of a refresh, emits an
+// event if it failed and returns the number of consecutive failures.
+func (rotater *TLSRotater) recordRefresh(err error) int {
+	rotater.statusMu.Lock()
+	rotater.lastError = err
+	if err != nil {
+		rotater.failures++
+	} else {
+		rotater.failures = 0
+		rotater.lastRefresh = time.Now()
+	}
+	failures := rotater.failures
+	rotater.statusMu.Unlock()
+
+	if err != nil {
+		rotater.emit(Event{
+			Type:     EventRefreshFailed,
+			Err:      err,
+			Reason:   failureReason(err),
+			Failures: failures,
+		})
+	}
+	return failures
+}
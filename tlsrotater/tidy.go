@@ -0,0 +1,205 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VaultTidier periodically tidies expired and revoked certificates from a
+// Vault PKI mount. When a lock path is configured, a leader lock stored in a
+// KV version 2 mount makes sure only one of the replicas sharing that path
+// tidies per interval.
+type VaultTidier struct {
+	issuer       *VaultIssuer
+	interval     time.Duration
+	safetyBuffer time.Duration
+	lockPath     string
+	holder       string
+
+	// cancel stops the loop started by Start, which closes done once it has
+	// returned.
+	lifecycleMu sync.Mutex
+	cancel      context.CancelFunc
+	done        chan struct{}
+}
+
+// TidierOption configures a VaultTidier.
+type TidierOption func(*VaultTidier)
+
+// WithTidyInterval sets how often to tidy. Defaults to one hour. The interval
+// has to be positive, or Start fails.
+func WithTidyInterval(interval time.Duration) TidierOption {
+	return func(tidier *VaultTidier) {
+		tidier.interval = interval
+	}
+}
+
+// WithTidySafetyBuffer sets how long past expiry certificates are kept before
+// being tidied. Defaults to 72 hours.
+func WithTidySafetyBuffer(safetyBuffer time.Duration) TidierOption {
+	return func(tidier *VaultTidier) {
+		tidier.safetyBuffer = safetyBuffer
+	}
+}
+
+// WithTidyLock sets the KV version 2 data path of the leader lock, such as
+// "secret/data/tlsrotater/tidy-lock". Without it every replica tidies.
+func WithTidyLock(path string) TidierOption {
+	return func(tidier *VaultTidier) {
+		tidier.lockPath = strings.Trim(path, "/")
+	}
+}
+
+// NewVaultTidier creates a VaultTidier for the PKI mount of the given issuer,
+// later to be started with Start.
+func NewVaultTidier(issuer *VaultIssuer, options ...TidierOption) *VaultTidier {
+	hostname, _ := os.Hostname()
+	tidier := &VaultTidier{
+		issuer:       issuer,
+		interval:     time.Hour,
+		safetyBuffer: 72 * time.Hour,
+		holder:       fmt.Sprintf("%v-%d", hostname, os.Getpid()),
+	}
+	for _, option := range options {
+		option(tidier)
+	}
+	return tidier
+}
+
+// Start tidies every interval in the background until Stop is called.
+// Starting a tidier that is already started does nothing.
+func (tidier *VaultTidier) Start() error {
+	if tidier.interval <= 0 {
+		return fmt.Errorf("Invalid tidy interval %v: must be positive", tidier.interval)
+	}
+	tidier.lifecycleMu.Lock()
+	defer tidier.lifecycleMu.Unlock()
+	if tidier.done != nil {
+		return nil
+	}
+	var ctx context.Context
+	ctx, tidier.cancel = context.WithCancel(context.Background())
+	tidier.done = make(chan struct{})
+	go tidier.loop(ctx, tidier.done)
+	return nil
+}
+
+// loop tidies every interval until the context is cancelled.
+func (tidier *VaultTidier) loop(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(tidier.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := tidier.run(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error while tidying %v: %v\n", tidier.issuer.mount, err)
+			}
+		}
+	}
+}
+
+// Stop stops tidying and waits for a tidy in progress to finish. It is safe
+// to call more than once.
+func (tidier *VaultTidier) Stop() {
+	tidier.lifecycleMu.Lock()
+	cancel, done := tidier.cancel, tidier.done
+	tidier.lifecycleMu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// run tidies the PKI mount if this replica holds the lock.
+func (tidier *VaultTidier) run() error {
+	if tidier.lockPath != "" {
+		acquired, err := tidier.acquireLock()
+		if err != nil {
+			return fmt.Errorf("Couldn't acquire tidy lock: %v", err)
+		}
+		if !acquired {
+			return nil
+		}
+	}
+	tidyParams := make(map[string]interface{})
+	tidyParams["tidy_cert_store"] = true
+	tidyParams["tidy_revocation_list"] = true
+	tidyParams["safety_buffer"] = tidier.safetyBuffer.String()
+	secret, err := tidier.issuer.vault().Logical().Write(tidier.issuer.mount+"/tidy", tidyParams)
+	if err != nil {
+		return err
+	}
+	if secret != nil && len(secret.Warnings) > 0 {
+		log.Printf("Tidied %v: %v\n", tidier.issuer.mount, strings.Join(secret.Warnings, "; "))
+	} else {
+		log.Printf("Tidied %v\n", tidier.issuer.mount)
+	}
+	return nil
+}
+
+// acquireLock takes or renews the leader lock for one interval. It relies on
+// the check-and-set of KV version 2, so that of several replicas racing for
+// an expired lock only one write succeeds.
+func (tidier *VaultTidier) acquireLock() (bool, error) {
+	secret, err := tidier.issuer.vault().Logical().Read(tidier.lockPath)
+	if err != nil {
+		return false, err
+	}
+	var version int64
+	if secret != nil {
+		if metadata, ok := secret.Data["metadata"].(map[string]interface{}); ok {
+			if number, ok := metadata["version"].(json.Number); ok {
+				version, _ = number.Int64()
+			}
+		}
+		if data, ok := secret.Data["data"].(map[string]interface{}); ok {
+			holder, _ := data["holder"].(string)
+			expires, _ := time.Parse(time.RFC3339, fmt.Sprint(data["expires"]))
+			if holder != tidier.holder && time.Now().Before(expires) {
+				return false, nil
+			}
+		}
+	}
+	lockParams := map[string]interface{}{
+		"options": map[string]interface{}{
+			"cas": version,
+		},
+		"data": map[string]interface{}{
+			"holder":  tidier.holder,
+			"expires": time.Now().Add(tidier.interval).Format(time.RFC3339),
+		},
+	}
+	if _, err := tidier.issuer.vault().Logical().Write(tidier.lockPath, lockParams); err != nil {
+		// Most likely another replica won the check-and-set
+		log.Printf("Not tidying, tidy lock %v is taken: %v\n", tidier.lockPath, err)
+		return false, nil
+	}
+	return true, nil
+}
@@ -0,0 +1,62 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sirlatrom/tls-sidecar-playground/tlsrotater/vaulttest"
+)
+
+func TestTidierStop(t *testing.T) {
+	server, issuer := newTestIssuer(t)
+	tidier := NewVaultTidier(issuer, WithTidyInterval(10*time.Millisecond))
+	for i := 0; i < 2; i++ {
+		if err := tidier.Start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for server.Requests(vaulttest.EndpointTidy) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Never tidied")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	tidier.Stop()
+	tidier.Stop()
+	checkNoGoroutine(t, "(*VaultTidier)")
+	tidied := server.Requests(vaulttest.EndpointTidy)
+	time.Sleep(50 * time.Millisecond)
+	if got := server.Requests(vaulttest.EndpointTidy); got != tidied {
+		t.Errorf("Tidied %d more times after stopping", got-tidied)
+	}
+}
+
+func TestTidierInvalidInterval(t *testing.T) {
+	for _, interval := range []time.Duration{0, -time.Minute} {
+		_, issuer := newTestIssuer(t)
+		tidier := NewVaultTidier(issuer, WithTidyInterval(interval))
+		if err := tidier.Start(); err == nil {
+			tidier.Stop()
+			t.Errorf("Started with interval %v", interval)
+		}
+		checkNoGoroutine(t, "(*VaultTidier)")
+	}
+}
@@ -18,150 +18,381 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package tlsrotater
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/json"
 	"fmt"
 	"log"
 	"math/rand"
+	"net/url"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	vaultapi "github.com/hashicorp/vault/api"
 )
 
 // TLSRotater rotates when necessary
 type TLSRotater struct {
-	CACertPool *x509.CertPool
+	issuer          Issuer
+	request         CertificateRequest
+	keyType         KeyType
+	renewalFraction float64
+	renewalJitter   float64
+	backoff         Backoff
+	trust           *trustStore
+	trustInterval   time.Duration
+	tokenSource     *TokenSource
+	securityProfile SecurityProfile
+	spiffeID        *SPIFFEID
+
+	ocspStapling  bool
+	ocspResponder string
+	staple        atomic.Pointer[ocspStaple]
+
+	crlChecking     bool
+	crlPolicy       CRLPolicy
+	crlInterval     time.Duration
+	crlMaxStaleness time.Duration
+	crl             atomic.Pointer[revocationList]
+
+	cacheDir         string
+	cacheMinValidity time.Duration
+
+	eventsMu sync.Mutex
+	handlers []func(Event)
+	// closers close the channels returned by Events on shutdown, after
+	// which eventsClosed makes Events return closed channels.
+	closers      []func()
+	eventsClosed bool
 
-	client     *vaultapi.Client
-	commonName string
+	revocationPolicy   RevocationPolicy
+	revocationGrace    time.Duration
+	revokeOnStop       bool
+	revocationMu       sync.Mutex
+	pendingRevocations []*pendingRevocation
 
-	certMu  sync.RWMutex
-	ticker  *time.Ticker
-	keypair *tls.Certificate
-	serial  *string
+	// refreshMu serializes refreshes. Handshakes never take it; they read
+	// the current certificate through an atomic pointer instead.
+	refreshMu sync.Mutex
+	current   atomic.Pointer[Certificate]
+
+	// cancel stops the renewal loop started by Start, which closes done
+	// once it has shut down.
+	lifecycleMu sync.Mutex
+	cancel      context.CancelFunc
+	done        chan struct{}
+
+	statusMu    sync.Mutex
+	lastRefresh time.Time
+	lastError   error
+	failures    int
 }
 
+// minRefreshInterval keeps a nearly expired certificate from making the
+// rotater refresh in a tight loop.
+const minRefreshInterval = time.Second
+
 // NewTLSRotater is used to create a TLSRotater later to be started with Start.
+// Certificates are issued and revoked through the given Issuer.
 //
 // To be used like this for clients:
-//  rotater := tlsrotater.NewTLSRotater(client, "outproxy", []string{"localhost"})
-//  if err := rotater.Start(); err != nil {
+//  issuer := tlsrotater.NewVaultIssuer(client, tlsrotater.WithRole("outproxy"))
+//  rotater := tlsrotater.NewTLSRotater(issuer, "outproxy", tlsrotater.WithDNSNames("localhost"))
+//  if err := rotater.Start(context.Background()); err != nil {
 //  	panic(err)
 //  }
 //  defer rotater.Stop()
 //  log.Println("Created keypair reloader")
-//  	tlsConfig := tls.Config{
-//  	RootCAs:              rotater.CACertPool,
-//  	GetClientCertificate: rotater.GetClientCertificateFunc(),
+//  transport := &http.Transport{
+//  	TLSClientConfig: rotater.ClientTLSConfig(),
 //  }
-func NewTLSRotater(client *vaultapi.Client, commonName string, altNames []string) *TLSRotater {
-	return &TLSRotater{
-		commonName: commonName,
-		client:     client,
+func NewTLSRotater(issuer Issuer, commonName string, options ...Option) *TLSRotater {
+	rotater := &TLSRotater{
+		issuer: issuer,
+		request: CertificateRequest{
+			CommonName: commonName,
+			TTL:        5 * time.Minute,
+		},
+		renewalFraction: 0.6,
+		renewalJitter:   0.2,
+		backoff:         DefaultBackoff,
+		trust:           newTrustStore(24 * time.Hour),
+		trustInterval:   5 * time.Minute,
+		revocationGrace: time.Minute,
+	}
+	for _, option := range options {
+		option(rotater)
 	}
+	if rotater.spiffeID != nil {
+		// Copy the URIs given to WithURIs, so that the caller's slice isn't
+		// appended to.
+		uris := make([]*url.URL, 0, len(rotater.request.URIs)+1)
+		uris = append(uris, rotater.request.URIs...)
+		rotater.request.URIs = append(uris, rotater.spiffeID.URL())
+	}
+	return rotater
 }
 
 func (rotater *TLSRotater) refresh() error {
-	rotater.certMu.Lock()
-	defer rotater.certMu.Unlock()
-	previousSerial := rotater.serial
-
-	// Retrieve new keypair
-	params := make(map[string]interface{})
-	params["common_name"] = rotater.commonName
-	params["alt_names"] = "localhost"
-	params["ttl"] = "5m"
-	secret, err := rotater.client.Logical().Write("pki/issue/"+rotater.commonName, params)
-	if err != nil {
+	rotater.refreshMu.Lock()
+	defer rotater.refreshMu.Unlock()
+	previous := rotater.current.Load()
+
+	// Fetch the trust bundle first, so that a failure to do so doesn't leave
+	// a certificate issued but never served nor revoked
+	if err := rotater.refreshTrust(); err != nil {
 		return err
 	}
 
-	// Extract the data
-	certificateContents := []byte(secret.Data["certificate"].(string))
-	privateKeyContents := []byte(secret.Data["private_key"].(string))
-	if keypair, err := tls.X509KeyPair(certificateContents, privateKeyContents); err == nil {
-		var caChainContents []byte
-		if secret.Data["ca_chain"] != nil {
-			caChainContents = []byte(secret.Data["ca_chain"].(string))
-		} else {
-			caChainContents = []byte(secret.Data["issuing_ca"].(string))
-		}
-		rotater.CACertPool = x509.NewCertPool()
-		if ok := rotater.CACertPool.AppendCertsFromPEM(caChainContents); !ok {
-			return fmt.Errorf("Error loading CA chain")
-		}
-		newSerial := secret.Data["serial_number"].(string)
-		rotater.serial = &newSerial
-		rotater.keypair = &keypair
-	} else {
-		return fmt.Errorf("Couldn't load cert: %v", err)
-	}
-
-	// Revoke the previous cert
-	if previousSerial != nil {
-		revokeParams := make(map[string]interface{})
-		revokeParams["serial_number"] = *previousSerial
-		secret, err := rotater.client.Logical().Write("pki/revoke", revokeParams)
+	// Retrieve new keypair while the previous one keeps serving handshakes
+	request := rotater.request
+	if rotater.keyType != KeyIssuerGenerated {
+		key, err := generateKey(rotater.keyType)
 		if err != nil {
-			return fmt.Errorf("Couldn't revoke previous certificate: %v", err)
+			return &refreshError{reason: ReasonKeyGeneration, err: fmt.Errorf("Couldn't generate private key: %v", err)}
 		}
-		revocationTimeNumber, err := secret.Data["revocation_time"].(json.Number).Int64()
+		request.Key = key
+	}
+	issueStarted := time.Now()
+	certificate, err := rotater.issuer.Issue(request)
+	if err != nil {
+		return &refreshError{reason: ReasonIssue, err: err}
+	}
+	latency := time.Since(issueStarted)
+	if certificate.Keypair.Leaf == nil {
+		leaf, err := x509.ParseCertificate(certificate.Keypair.Certificate[0])
 		if err != nil {
-			return fmt.Errorf("Couldn't parse revocation time number: %v", err)
+			return &refreshError{reason: ReasonInvalidCertificate, err: fmt.Errorf("Couldn't parse issued certificate: %v", err)}
 		}
-		log.Printf("Old certificate revoked at %v\n", time.Unix(revocationTimeNumber, 0))
-		tidyParams := make(map[string]interface{})
-		tidyParams["tidy_cert_store"] = true
-		tidyParams["tidy_revocation_list"] = true
-		tidyParams["safety_buffer"] = (5 * time.Minute).String()
-		rotater.client.Logical().Write("pki/tidy", tidyParams)
+		certificate.Keypair.Leaf = leaf
 	}
-	log.Printf("Refreshed certificate. New serial: %v\n", *rotater.serial)
+	rotater.current.Store(certificate)
+	if err := rotater.saveCache(certificate); err != nil {
+		fmt.Fprintf(os.Stderr, "Error while caching certificate: %v\n", err)
+	}
+	rotater.rotated(certificate, previous, latency)
+
+	// Revoke the previous cert according to the policy
+	if previous != nil {
+		rotater.scheduleRevocation(previous)
+		rotater.revokeDue(false)
+	}
+	log.Printf("Refreshed certificate. New serial: %v, valid until %v\n", certificate.Serial, certificate.Keypair.Leaf.NotAfter)
+	rotater.stapleCurrent()
+
+	return nil
+}
+
+// nextRefresh returns how long to wait before renewing the current
+// certificate: the renewal fraction plus jitter of its remaining lifetime.
+func (rotater *TLSRotater) nextRefresh() time.Duration {
+	leaf := rotater.current.Load().Keypair.Leaf
+	now := time.Now()
+	start := now
+	if leaf.NotBefore.After(now) {
+		start = leaf.NotBefore
+	}
+	multiplier := rotater.renewalFraction + rotater.renewalJitter*rand.Float64()
+	wait := start.Sub(now) + time.Duration(multiplier*float64(leaf.NotAfter.Sub(start)))
+	if wait < minRefreshInterval {
+		wait = minRefreshInterval
+	}
+	return wait
+}
+
+// CertPool returns the roots currently trusted for verifying peers. The pool
+// is replaced when the trust bundle changes, so it should be fetched again
+// rather than kept; ServerTLSConfig and ClientTLSConfig do this per handshake.
+func (rotater *TLSRotater) CertPool() *x509.CertPool {
+	return rotater.trust.Pool()
+}
 
+// keypair returns the current keypair, with its OCSP response stapled if
+// there is one, or nil if none has been issued yet.
+func (rotater *TLSRotater) keypair() *tls.Certificate {
+	if certificate := rotater.current.Load(); certificate != nil {
+		return rotater.stapled(certificate)
+	}
 	return nil
 }
 
 func (rotater *TLSRotater) GetCertificateFunc() func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
 	return func(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-		rotater.certMu.RLock()
-		defer rotater.certMu.RUnlock()
-		return rotater.keypair, nil
+		return rotater.keypair(), nil
 	}
 }
 
 func (rotater *TLSRotater) GetClientCertificateFunc() func(requestInfo *tls.CertificateRequestInfo) (*tls.Certificate, error) {
 	return func(requestInfo *tls.CertificateRequestInfo) (*tls.Certificate, error) {
-		rotater.certMu.RLock()
-		defer rotater.certMu.RUnlock()
-		return rotater.keypair, nil
+		return rotater.keypair(), nil
 	}
 }
 
-func (rotater *TLSRotater) Start() error {
-	err := rotater.refresh()
-	if err != nil {
-		return fmt.Errorf("Error during start: #%v", err)
-	}
-	multiplier := 0.7 + 0.2*rand.Float64()
-	ticker := time.NewTicker(time.Duration(int64(multiplier * float64(time.Minute.Nanoseconds()))))
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				if err := rotater.refresh(); err != nil {
-					fmt.Fprintf(os.Stderr, "Error while refreshing certs: %v\n", err)
+// Start issues the first certificate, retrying according to the backoff
+// policy, unless a cached one can be used, and then keeps renewing it in the
+// background until the context is cancelled or Stop is called. While renewals
+// fail, the last good certificate keeps being served until it expires.
+func (rotater *TLSRotater) Start(ctx context.Context) error {
+	if err := rotater.validate(); err != nil {
+		return err
+	}
+	rotater.lifecycleMu.Lock()
+	defer rotater.lifecycleMu.Unlock()
+	if rotater.done != nil {
+		return fmt.Errorf("Rotater already started")
+	}
+	started := time.Now()
+	if rotater.restoreCache() {
+		rotater.recordRefresh(nil)
+	}
+	for rotater.current.Load() == nil {
+		err := rotater.refresh()
+		failures := rotater.recordRefresh(err)
+		if err == nil {
+			break
+		}
+		wait := rotater.backoff.delay(failures)
+		if rotater.backoff.MaxElapsed > 0 && time.Since(started)+wait > rotater.backoff.MaxElapsed {
+			return fmt.Errorf("Error during start: #%v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Error while issuing first cert (attempt %d), retrying in %v: %v\n", failures, wait, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+	rotater.refreshCRLLogged()
+	ctx, rotater.cancel = context.WithCancel(ctx)
+	rotater.done = make(chan struct{})
+	go rotater.run(ctx, rotater.done)
+	return nil
+}
+
+// validate checks the options the rotater was created with.
+func (rotater *TLSRotater) validate() error {
+	if rotater.renewalFraction <= 0 || rotater.renewalJitter < 0 || rotater.renewalFraction+rotater.renewalJitter > 1 {
+		return fmt.Errorf("Invalid renewal fraction %v with jitter %v: the fraction must be positive, the jitter not negative, and both add up to at most 1", rotater.renewalFraction, rotater.renewalJitter)
+	}
+	if rotater.trustInterval <= 0 {
+		return fmt.Errorf("Invalid trust refresh interval %v: must be positive", rotater.trustInterval)
+	}
+	if rotater.crlChecking && rotater.crlInterval <= 0 {
+		return fmt.Errorf("Invalid CRL interval %v: must be positive", rotater.crlInterval)
+	}
+	return nil
+}
+
+// Run starts the rotater and blocks until the context is cancelled and the
+// rotater has shut down.
+func (rotater *TLSRotater) Run(ctx context.Context) error {
+	if err := rotater.Start(ctx); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	rotater.Stop()
+	return nil
+}
+
+// run renews the certificate and revokes replaced ones until the context is
+// cancelled, and then shuts down.
+func (rotater *TLSRotater) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	timer := time.NewTimer(rotater.nextRefresh())
+	defer timer.Stop()
+	revocationTicker := time.NewTicker(revocationInterval)
+	defer revocationTicker.Stop()
+	trustTicker := time.NewTicker(rotater.trustInterval)
+	defer trustTicker.Stop()
+	var stapleTimer *time.Timer
+	var stapleC <-chan time.Time
+	if rotater.ocspStapling {
+		if rotater.staple.Load() == nil {
+			rotater.stapleCurrent()
+		}
+		stapleTimer = time.NewTimer(rotater.nextStapleRefresh())
+		defer stapleTimer.Stop()
+		stapleC = stapleTimer.C
+	}
+	var crlC <-chan time.Time
+	if rotater.crlChecking {
+		crlTicker := time.NewTicker(rotater.crlInterval)
+		defer crlTicker.Stop()
+		crlC = crlTicker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			rotater.shutdown()
+			return
+		case <-timer.C:
+			err := rotater.refresh()
+			failures := rotater.recordRefresh(err)
+			var wait time.Duration
+			if err == nil {
+				wait = rotater.nextRefresh()
+				if stapleTimer != nil {
+					stapleTimer.Reset(rotater.nextStapleRefresh())
 				}
+			} else {
+				wait = rotater.backoff.delay(failures)
+				fmt.Fprintf(os.Stderr, "Error while refreshing certs (%v, attempt %d), retrying in %v: %v\n", rotater.State(), failures, wait, err)
+			}
+			timer.Reset(wait)
+		case <-revocationTicker.C:
+			rotater.revokeDue(false)
+		case <-trustTicker.C:
+			if err := rotater.refreshTrust(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error while refreshing trust bundle: %v\n", err)
 			}
+		case <-crlC:
+			rotater.refreshCRLLogged()
+		case <-stapleC:
+			rotater.stapleCurrent()
+			stapleTimer.Reset(rotater.nextStapleRefresh())
 		}
-	}()
-	return nil
+	}
+}
+
+// shutdown revokes the replaced certificates still pending revocation, and
+// the current one as well if the rotater was configured to.
+func (rotater *TLSRotater) shutdown() {
+	rotater.refreshMu.Lock()
+	defer rotater.refreshMu.Unlock()
+	defer rotater.closeEvents()
+	rotater.revokeDue(true)
+	if !rotater.revokeOnStop {
+		return
+	}
+	certificate := rotater.current.Load()
+	if certificate == nil {
+		return
+	}
+	if err := rotater.issuer.Revoke(certificate.Serial); err != nil {
+		fmt.Fprintf(os.Stderr, "Error while revoking current certificate %v: %v\n", certificate.Serial, err)
+		rotater.emit(Event{
+			Type:      EventRevocationFailed,
+			OldSerial: certificate.Serial,
+			Err:       err,
+			Reason:    ReasonRevoke,
+			Failures:  1,
+		})
+		return
+	}
+	if err := rotater.removeCache(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error while removing cached certificate: %v\n", err)
+	}
 }
 
+// Stop stops renewing and waits for the rotater to shut down. It is safe to
+// call more than once, and after the context given to Start is cancelled.
 func (rotater *TLSRotater) Stop() {
-	if rotater.ticker != nil {
-		rotater.ticker.Stop()
+	rotater.lifecycleMu.Lock()
+	cancel, done := rotater.cancel, rotater.done
+	rotater.lifecycleMu.Unlock()
+	if cancel == nil {
+		return
 	}
+	cancel()
+	<-done
 }
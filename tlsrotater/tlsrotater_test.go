@@ -0,0 +1,461 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirlatrom/tls-sidecar-playground/tlsrotater/vaulttest"
+)
+
+// testBackoff retries as quickly as the rotater allows.
+var testBackoff = Backoff{
+	Initial:    10 * time.Millisecond,
+	Max:        10 * time.Millisecond,
+	Multiplier: 1,
+	MaxElapsed: 5 * time.Second,
+}
+
+// newTestIssuer starts a vaulttest.Server and returns it with a VaultIssuer
+// using it.
+func newTestIssuer(t testing.TB) (*vaulttest.Server, *VaultIssuer) {
+	t.Helper()
+	server := vaulttest.NewServer()
+	t.Cleanup(server.Close)
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, NewVaultIssuer(client)
+}
+
+// startTestRotater starts a rotater issuing through the issuer and returns it
+// with a channel receiving its events, including those of the start.
+func startTestRotater(t testing.TB, issuer Issuer, options ...Option) (*TLSRotater, <-chan Event) {
+	t.Helper()
+	rotater := NewTLSRotater(issuer, "test", append([]Option{WithBackoff(testBackoff)}, options...)...)
+	events := rotater.Events(64)
+	if err := rotater.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(rotater.Stop)
+	return rotater, events
+}
+
+// nextEvent returns the next event of the given type, skipping others.
+func nextEvent(t testing.TB, events <-chan Event, eventType EventType) Event {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatalf("Events closed before a %v event", eventType)
+			}
+			if event.Type == eventType {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("No %v event", eventType)
+		}
+	}
+}
+
+// checkNoGoroutine fails unless no goroutine is running the given function,
+// such as "(*TLSRotater).run", once those stopping have returned.
+func checkNoGoroutine(t testing.TB, function string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for goroutineRunning(function) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Goroutine running %v leaked", function)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// goroutineRunning reports whether any goroutine is running the given
+// function of the package.
+func goroutineRunning(function string) bool {
+	buf := make([]byte, 1<<20)
+	return strings.Contains(string(buf[:runtime.Stack(buf, true)]), "tlsrotater."+function)
+}
+
+// verifyLeaf verifies a certificate against the roots trusted by the rotater.
+func verifyLeaf(rotater *TLSRotater, leaf *x509.Certificate) error {
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:     rotater.CertPool(),
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+func TestIssue(t *testing.T) {
+	spiffeURI, _ := url.Parse("spiffe://example.org/test")
+	tests := []struct {
+		name     string
+		keyType  KeyType
+		endpoint string
+	}{
+		{"issuer generated key", KeyIssuerGenerated, vaulttest.EndpointIssue},
+		{"ECDSA P-256 key", KeyECDSAP256, vaulttest.EndpointSign},
+		{"RSA 2048 key", KeyRSA2048, vaulttest.EndpointSign},
+		{"Ed25519 key", KeyEd25519, vaulttest.EndpointSign},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, issuer := newTestIssuer(t)
+			rotater, events := startTestRotater(t, issuer,
+				WithKeyType(test.keyType),
+				WithDNSNames("test.example.org"),
+				WithIPAddresses(net.ParseIP("127.0.0.1")),
+				WithURIs(spiffeURI),
+			)
+			event := nextEvent(t, events, EventRotated)
+			status := rotater.Status()
+			if status.State != StateHealthy || status.Failures != 0 {
+				t.Fatalf("Status is %v with %d failures, want healthy", status.State, status.Failures)
+			}
+			if status.Serial != event.NewSerial {
+				t.Errorf("Status serial is %v, event serial %v", status.Serial, event.NewSerial)
+			}
+			if _, ok := server.Issued()[status.Serial]; !ok {
+				t.Errorf("Serial %v wasn't issued by the server", status.Serial)
+			}
+			if got := server.Requests(test.endpoint); got != 1 {
+				t.Errorf("%d requests to %v, want 1", got, test.endpoint)
+			}
+			leaf := rotater.keypair().Leaf
+			if !status.NotAfter.Equal(leaf.NotAfter) {
+				t.Errorf("Status not after is %v, certificate's %v", status.NotAfter, leaf.NotAfter)
+			}
+			if err := leaf.VerifyHostname("test.example.org"); err != nil {
+				t.Error(err)
+			}
+			if err := leaf.VerifyHostname("127.0.0.1"); err != nil {
+				t.Error(err)
+			}
+			if len(leaf.URIs) != 1 || leaf.URIs[0].String() != spiffeURI.String() {
+				t.Errorf("URI SANs are %v, want %v", leaf.URIs, spiffeURI)
+			}
+			if err := verifyLeaf(rotater, leaf); err != nil {
+				t.Errorf("Certificate isn't trusted: %v", err)
+			}
+		})
+	}
+}
+
+func TestRefreshFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		keyType  KeyType
+		endpoint string
+		fault    vaulttest.Fault
+		reason   string
+	}{
+		{"issue unavailable", KeyIssuerGenerated, vaulttest.EndpointIssue, vaulttest.Fault{Status: http.StatusServiceUnavailable}, ReasonIssue},
+		{"issue malformed", KeyIssuerGenerated, vaulttest.EndpointIssue, vaulttest.Fault{Malformed: true}, ReasonIssue},
+		{"sign denied", KeyECDSAP256, vaulttest.EndpointSign, vaulttest.Fault{Status: http.StatusForbidden}, ReasonIssue},
+		{"sign malformed", KeyECDSAP256, vaulttest.EndpointSign, vaulttest.Fault{Malformed: true}, ReasonIssue},
+		{"trust bundle unavailable", KeyIssuerGenerated, vaulttest.EndpointCA, vaulttest.Fault{Status: http.StatusInternalServerError}, ReasonTrustBundle},
+		{"trust bundle malformed", KeyIssuerGenerated, vaulttest.EndpointCA, vaulttest.Fault{Malformed: true}, ReasonTrustBundle},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, issuer := newTestIssuer(t)
+			rotater, events := startTestRotater(t, issuer, WithKeyType(test.keyType))
+			serial := nextEvent(t, events, EventRotated).NewSerial
+
+			server.Inject(test.endpoint, test.fault)
+			err := rotater.refresh()
+			if err == nil {
+				t.Fatal("Refresh succeeded despite the fault")
+			}
+			rotater.recordRefresh(err)
+			if event := nextEvent(t, events, EventRefreshFailed); event.Reason != test.reason || event.Failures != 1 {
+				t.Errorf("Failure event has reason %q after %d failures, want %q after 1", event.Reason, event.Failures, test.reason)
+			}
+			status := rotater.Status()
+			if status.State != StateDegraded || status.Failures != 1 || status.LastError == nil {
+				t.Errorf("Status is %v with %d failures and error %v, want degraded with 1", status.State, status.Failures, status.LastError)
+			}
+			if status.Serial != serial {
+				t.Errorf("Serving %v, want the last good certificate %v", status.Serial, serial)
+			}
+			for issued := range server.Issued() {
+				if issued != serial {
+					t.Errorf("Certificate %v was issued by the failed refresh and left unused", issued)
+				}
+			}
+
+			server.ClearFaults()
+			err = rotater.refresh()
+			rotater.recordRefresh(err)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if event := nextEvent(t, events, EventRotated); event.OldSerial != serial {
+				t.Errorf("Rotated from %v, want %v", event.OldSerial, serial)
+			}
+			if status := rotater.Status(); status.State != StateHealthy || status.Failures != 0 {
+				t.Errorf("Status is %v with %d failures after recovering, want healthy", status.State, status.Failures)
+			}
+		})
+	}
+}
+
+func TestIssueLatency(t *testing.T) {
+	server, issuer := newTestIssuer(t)
+	rotater, events := startTestRotater(t, issuer)
+	nextEvent(t, events, EventRotated)
+
+	latency := 200 * time.Millisecond
+	server.Inject(vaulttest.EndpointIssue, vaulttest.Fault{Latency: latency, Count: 1})
+	if err := rotater.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if event := nextEvent(t, events, EventRotated); event.Latency < latency {
+		t.Errorf("Rotation latency is %v, want at least %v", event.Latency, latency)
+	}
+}
+
+func TestStart(t *testing.T) {
+	tests := []struct {
+		name     string
+		fault    vaulttest.Fault
+		backoff  Backoff
+		wantErr  bool
+		requests int
+	}{
+		{"first attempt", vaulttest.Fault{}, testBackoff, false, 1},
+		{"retried", vaulttest.Fault{Status: http.StatusServiceUnavailable, Count: 1}, testBackoff, false, 2},
+		{"given up", vaulttest.Fault{Status: http.StatusServiceUnavailable}, Backoff{Initial: time.Second, Max: time.Second, Multiplier: 1, MaxElapsed: time.Second / 2}, true, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, issuer := newTestIssuer(t)
+			server.Inject(vaulttest.EndpointIssue, test.fault)
+			rotater := NewTLSRotater(issuer, "test", WithBackoff(test.backoff))
+			err := rotater.Start(context.Background())
+			defer rotater.Stop()
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Start returned %v, want error %v", err, test.wantErr)
+			}
+			if got := server.Requests(vaulttest.EndpointIssue); got != test.requests {
+				t.Errorf("%d issue requests, want %d", got, test.requests)
+			}
+			wantState := StateHealthy
+			if test.wantErr {
+				wantState = StateFailed
+			}
+			if state := rotater.State(); state != wantState {
+				t.Errorf("State is %v, want %v", state, wantState)
+			}
+		})
+	}
+}
+
+func TestNextRefresh(t *testing.T) {
+	tests := []struct {
+		name      string
+		notBefore time.Duration
+		notAfter  time.Duration
+		fraction  float64
+		jitter    float64
+		min, max  time.Duration
+	}{
+		{"just issued", 0, 10 * time.Minute, 0.5, 0, 5 * time.Minute, 5 * time.Minute},
+		{"with jitter", 0, 10 * time.Minute, 0.5, 0.2, 5 * time.Minute, 7 * time.Minute},
+		{"issued a while ago", -4 * time.Minute, 6 * time.Minute, 0.5, 0, 3 * time.Minute, 3 * time.Minute},
+		{"not valid yet", time.Minute, 10 * time.Minute, 0.5, 0, 5*time.Minute + 30*time.Second, 5*time.Minute + 30*time.Second},
+		{"renewed at expiry", 0, 10 * time.Minute, 0.8, 0.2, 8 * time.Minute, 10 * time.Minute},
+		{"about to expire", -10 * time.Minute, 500 * time.Millisecond, 0.5, 0, minRefreshInterval, minRefreshInterval},
+		{"expired", -10 * time.Minute, -time.Minute, 0.5, 0, minRefreshInterval, minRefreshInterval},
+	}
+	// Time passes between setting up the certificate and nextRefresh
+	const slack = 100 * time.Millisecond
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rotater := NewTLSRotater(nil, "test", WithRenewalFraction(test.fraction), WithRenewalJitter(test.jitter))
+			if err := rotater.validate(); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 100; i++ {
+				now := time.Now()
+				rotater.current.Store(&Certificate{Keypair: &tls.Certificate{Leaf: &x509.Certificate{
+					NotBefore: now.Add(test.notBefore),
+					NotAfter:  now.Add(test.notAfter),
+				}}})
+				if wait := rotater.nextRefresh(); wait < test.min-slack || wait > test.max {
+					t.Fatalf("Refreshing in %v, want between %v and %v", wait, test.min, test.max)
+				}
+			}
+		})
+	}
+}
+
+func TestStartRejectsInvalidOptions(t *testing.T) {
+	tests := []struct {
+		name   string
+		option Option
+	}{
+		{"zero trust refresh interval", WithTrustRefreshInterval(0)},
+		{"negative trust refresh interval", WithTrustRefreshInterval(-time.Minute)},
+		{"zero CRL interval", WithCRLChecking(0, CRLFailOpen)},
+		{"negative CRL interval", WithCRLChecking(-time.Minute, CRLFailClosed)},
+		{"zero renewal fraction", WithRenewalFraction(0)},
+		{"negative renewal jitter", WithRenewalJitter(-0.1)},
+		{"renewal after expiry", WithRenewalFraction(0.9)},
+		{"renewal jitter past expiry", WithRenewalJitter(0.5)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, issuer := newTestIssuer(t)
+			rotater := NewTLSRotater(issuer, "test", WithBackoff(testBackoff), test.option)
+			if err := rotater.Start(context.Background()); err == nil {
+				rotater.Stop()
+				t.Fatal("Started despite the invalid option")
+			}
+			if requests := server.Requests(vaulttest.EndpointIssue); requests != 0 {
+				t.Errorf("Issued %d certificates despite the invalid option", requests)
+			}
+		})
+	}
+}
+
+func TestStopLeavesNoGoroutine(t *testing.T) {
+	tests := []struct {
+		name string
+		stop func(rotater *TLSRotater, cancel context.CancelFunc)
+	}{
+		{"stopped", func(rotater *TLSRotater, cancel context.CancelFunc) {
+			rotater.Stop()
+		}},
+		{"stopped twice", func(rotater *TLSRotater, cancel context.CancelFunc) {
+			rotater.Stop()
+			rotater.Stop()
+		}},
+		{"context cancelled", func(rotater *TLSRotater, cancel context.CancelFunc) {
+			cancel()
+		}},
+		{"context cancelled then stopped", func(rotater *TLSRotater, cancel context.CancelFunc) {
+			cancel()
+			rotater.Stop()
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, issuer := newTestIssuer(t)
+			rotater := NewTLSRotater(issuer, "test", WithBackoff(testBackoff), WithCRLChecking(time.Minute, CRLFailOpen))
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if err := rotater.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			test.stop(rotater, cancel)
+			checkNoGoroutine(t, "(*TLSRotater).run")
+		})
+	}
+}
+
+func TestRunReturnsWhenCancelled(t *testing.T) {
+	_, issuer := newTestIssuer(t)
+	rotater := NewTLSRotater(issuer, "test", WithBackoff(testBackoff))
+	events := rotater.Events(8)
+	ctx, cancel := context.WithCancel(context.Background())
+	returned := make(chan error, 1)
+	go func() {
+		returned <- rotater.Run(ctx)
+	}()
+	nextEvent(t, events, EventRotated)
+	cancel()
+	select {
+	case err := <-returned:
+		if err != nil {
+			t.Fatalf("Run returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after the context was cancelled")
+	}
+	checkNoGoroutine(t, "(*TLSRotater).run")
+	checkNoGoroutine(t, "(*TLSRotater).Run")
+}
+
+// BenchmarkHandshake measures TLS handshakes served through
+// GetCertificateFunc, both while idle and while certificates are being
+// refreshed back to back against a slow Vault.
+func BenchmarkHandshake(b *testing.B) {
+	for _, rotating := range []bool{false, true} {
+		name := "idle"
+		if rotating {
+			name = "rotating"
+		}
+		b.Run(name, func(b *testing.B) {
+			server, issuer := newTestIssuer(b)
+			rotater, _ := startTestRotater(b, issuer)
+			server.Inject(vaulttest.EndpointIssue, vaulttest.Fault{Latency: 50 * time.Millisecond})
+			stop, done := make(chan struct{}), make(chan struct{})
+			go func() {
+				defer close(done)
+				for rotating {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					if err := rotater.refresh(); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			}()
+			serverConfig := &tls.Config{GetCertificate: rotater.GetCertificateFunc()}
+			clientConfig := &tls.Config{RootCAs: rotater.CertPool(), ServerName: "test"}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				clientConn, serverConn := net.Pipe()
+				serverErr := make(chan error, 1)
+				go func() {
+					serverErr <- tls.Server(serverConn, serverConfig).Handshake()
+					serverConn.Close()
+				}()
+				err := tls.Client(clientConn, clientConfig).Handshake()
+				clientConn.Close()
+				if err == nil {
+					err = <-serverErr
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			close(stop)
+			<-done
+		})
+	}
+}
@@ -0,0 +1,327 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// Authenticator logs in to Vault.
+type Authenticator interface {
+	// Login returns a secret whose Auth carries the new token. The client is
+	// a copy that the Authenticator may change the token of.
+	Login(client *vaultapi.Client) (*vaultapi.Secret, error)
+}
+
+// withToken returns a copy of the client using the given token, leaving the
+// client itself unchanged.
+func withToken(client *vaultapi.Client, token string) *vaultapi.Client {
+	// Client.Clone would configure the shared transport again, which fails
+	clone := *client
+	clone.SetToken(token)
+	return &clone
+}
+
+// StaticToken is an Authenticator using a fixed token.
+type StaticToken string
+
+// Login implements Authenticator by looking up the token.
+func (token StaticToken) Login(client *vaultapi.Client) (*vaultapi.Secret, error) {
+	return lookupToken(client, string(token))
+}
+
+// TokenFile is an Authenticator using a token read from a file, such as a
+// Docker secret. The file is read again on every login.
+type TokenFile string
+
+// Login implements Authenticator by reading the file and looking up the token.
+func (path TokenFile) Login(client *vaultapi.Client) (*vaultapi.Secret, error) {
+	contents, err := ioutil.ReadFile(string(path))
+	if err != nil {
+		return nil, err
+	}
+	return lookupToken(client, strings.TrimSpace(string(contents)))
+}
+
+// loginWith logs in with the auth method mounted at the given path, without
+// the token that is about to be replaced.
+func loginWith(client *vaultapi.Client, mount string, params map[string]interface{}) (*vaultapi.Secret, error) {
+	return withToken(client, "").Logical().Write("auth/"+strings.Trim(mount, "/")+"/login", params)
+}
+
+// lookupToken turns a token into a login secret by looking it up.
+func lookupToken(client *vaultapi.Client, token string) (*vaultapi.Secret, error) {
+	client.SetToken(token)
+	secret, err := client.Auth().Token().LookupSelf()
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't look up token: %v", err)
+	}
+	auth := &vaultapi.SecretAuth{ClientToken: token}
+	if ttl, ok := secret.Data["ttl"].(json.Number); ok {
+		seconds, _ := ttl.Int64()
+		auth.LeaseDuration = int(seconds)
+	}
+	auth.Renewable, _ = secret.Data["renewable"].(bool)
+	return &vaultapi.Secret{Auth: auth}, nil
+}
+
+// TokenSource keeps the token of a Vault client valid. It renews the token
+// with a vaultapi.Renewer for as long as Vault allows, and logs in again
+// through its Authenticator when the token can no longer be renewed.
+type TokenSource struct {
+	auth    Authenticator
+	backoff Backoff
+
+	// tokenMu guards the token of client, as clients don't guard it
+	// themselves. Requests are made through copies taken by Client, so that
+	// the token can be switched while they are in flight.
+	tokenMu sync.RWMutex
+	client  *vaultapi.Client
+
+	// cancel stops the renewal started by Start, which closes done once it
+	// has returned.
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	statusMu    sync.Mutex
+	expires     time.Time
+	lastRenewal time.Time
+	lastError   error
+	failures    int
+	started     bool
+}
+
+// TokenStatus is a snapshot of the health of a TokenSource.
+type TokenStatus struct {
+	State State
+	// Expires is when the token expires. Zero means never.
+	Expires time.Time
+	// LastRenewal is when the token was last renewed or obtained.
+	LastRenewal time.Time
+	// LastError is the error of the latest renewal or login, if it failed.
+	LastError error
+	// Failures is the number of consecutive failed logins.
+	Failures int
+}
+
+// NewTokenSource creates a TokenSource for the given client, later to be
+// started with Start. The client isn't to be used directly while the token
+// source runs; requests are made through copies returned by Client, such as
+// by a VaultIssuer created WithClientSource(source.Client).
+func NewTokenSource(client *vaultapi.Client, auth Authenticator) *TokenSource {
+	return &TokenSource{
+		client:  client,
+		auth:    auth,
+		backoff: DefaultBackoff,
+	}
+}
+
+// Start logs in, retrying according to the backoff policy, and then keeps
+// the token valid in the background until the context is cancelled or Stop
+// is called.
+func (source *TokenSource) Start(ctx context.Context) error {
+	started := time.Now()
+	for {
+		secret, err := source.login()
+		if err == nil {
+			source.statusMu.Lock()
+			defer source.statusMu.Unlock()
+			if source.done != nil {
+				return fmt.Errorf("Token source already started")
+			}
+			ctx, source.cancel = context.WithCancel(ctx)
+			source.done = make(chan struct{})
+			go source.run(ctx, secret, source.done)
+			return nil
+		}
+		wait := source.backoff.delay(source.Status().Failures)
+		if source.backoff.MaxElapsed > 0 && time.Since(started)+wait > source.backoff.MaxElapsed {
+			return fmt.Errorf("Error during Vault login: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Error while logging in to Vault, retrying in %v: %v\n", wait, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Client returns a copy of the client with the current token, for making
+// requests while the token may be replaced.
+func (source *TokenSource) Client() *vaultapi.Client {
+	source.tokenMu.RLock()
+	defer source.tokenMu.RUnlock()
+	return withToken(source.client, source.client.Token())
+}
+
+// Stop stops renewing the token and waits for the renewal to stop. It is safe
+// to call more than once, and after the context given to Start is cancelled.
+func (source *TokenSource) Stop() {
+	source.statusMu.Lock()
+	cancel, done := source.cancel, source.done
+	source.statusMu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// run renews the token from the given login secret, and logs in again when
+// renewal is over, until the context is cancelled.
+func (source *TokenSource) run(ctx context.Context, secret *vaultapi.Secret, done chan struct{}) {
+	defer close(done)
+	for {
+		relogin := source.renew(ctx, secret)
+		if ctx.Err() != nil {
+			return
+		}
+		select {
+		case <-time.After(time.Until(relogin)):
+		case <-ctx.Done():
+			return
+		}
+		for {
+			var err error
+			if secret, err = source.login(); err == nil {
+				break
+			}
+			wait := source.backoff.delay(source.Status().Failures)
+			fmt.Fprintf(os.Stderr, "Error while logging in to Vault, retrying in %v: %v\n", wait, err)
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// renew keeps renewing the token of the login secret until Vault no longer
+// allows it, and returns when to log in again.
+func (source *TokenSource) renew(ctx context.Context, secret *vaultapi.Secret) time.Time {
+	lease := time.Duration(secret.Auth.LeaseDuration) * time.Second
+	if lease == 0 {
+		// The token never expires
+		<-ctx.Done()
+		return time.Now()
+	}
+	// The renewer keeps using its client after being stopped, so it gets a
+	// copy of its own.
+	renewer, err := withToken(source.Client(), secret.Auth.ClientToken).NewRenewer(&vaultapi.RenewerInput{Secret: secret})
+	if err != nil {
+		source.recordRenewal(err, 0)
+		return time.Now()
+	}
+	go renewer.Renew()
+	defer renewer.Stop()
+	for {
+		select {
+		case err := <-renewer.DoneCh():
+			if err == vaultapi.ErrRenewerNotRenewable {
+				// Use the token for most of its lifetime before replacing it
+				return source.Status().Expires.Add(-lease / 3)
+			}
+			if err != nil {
+				source.recordRenewal(fmt.Errorf("Couldn't renew token: %v", err), 0)
+			}
+			return time.Now()
+		case renewal := <-renewer.RenewCh():
+			if renewal.Secret != nil && renewal.Secret.Auth != nil {
+				source.recordRenewal(nil, time.Duration(renewal.Secret.Auth.LeaseDuration)*time.Second)
+			}
+		case <-ctx.Done():
+			return time.Now()
+		}
+	}
+}
+
+// login logs in through the Authenticator and switches the client to the
+// new token.
+func (source *TokenSource) login() (*vaultapi.Secret, error) {
+	secret, err := source.auth.Login(withToken(source.Client(), ""))
+	if err == nil && (secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "") {
+		err = fmt.Errorf("Login returned no token")
+	}
+	source.statusMu.Lock()
+	defer source.statusMu.Unlock()
+	source.started = true
+	source.lastError = err
+	if err != nil {
+		source.failures++
+		return nil, err
+	}
+	source.tokenMu.Lock()
+	source.client.SetToken(secret.Auth.ClientToken)
+	source.tokenMu.Unlock()
+	source.failures = 0
+	source.lastRenewal = time.Now()
+	source.expires = time.Time{}
+	if secret.Auth.LeaseDuration > 0 {
+		source.expires = source.lastRenewal.Add(time.Duration(secret.Auth.LeaseDuration) * time.Second)
+	}
+	log.Printf("Logged in to Vault. Token expires: %v\n", source.expires)
+	return secret, nil
+}
+
+// recordRenewal updates the status with the outcome of a renewal.
+func (source *TokenSource) recordRenewal(err error, lease time.Duration) {
+	source.statusMu.Lock()
+	defer source.statusMu.Unlock()
+	source.lastError = err
+	if err == nil {
+		source.lastRenewal = time.Now()
+		source.expires = source.lastRenewal.Add(lease)
+	}
+}
+
+// Status returns the current health of the token.
+func (source *TokenSource) Status() TokenStatus {
+	source.statusMu.Lock()
+	defer source.statusMu.Unlock()
+	status := TokenStatus{
+		Expires:     source.expires,
+		LastRenewal: source.lastRenewal,
+		LastError:   source.lastError,
+		Failures:    source.failures,
+	}
+	switch {
+	case !source.started:
+		status.State = StateStarting
+	case source.lastRenewal.IsZero():
+		status.State = StateFailed
+	case !source.expires.IsZero() && time.Now().After(source.expires):
+		status.State = StateFailed
+	case source.lastError != nil:
+		status.State = StateDegraded
+	default:
+		status.State = StateHealthy
+	}
+	return status
+}
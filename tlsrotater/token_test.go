@@ -0,0 +1,253 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/sirlatrom/tls-sidecar-playground/tlsrotater/vaulttest"
+)
+
+// shortLivedToken is an Authenticator handing out a token that can't be
+// renewed and expires after a second, so the TokenSource keeps logging in.
+type shortLivedToken struct {
+	logins int32
+}
+
+func (auth *shortLivedToken) Login(client *vaultapi.Client) (*vaultapi.Secret, error) {
+	atomic.AddInt32(&auth.logins, 1)
+	client.SetToken(vaulttest.Token)
+	return &vaultapi.Secret{Auth: &vaultapi.SecretAuth{ClientToken: vaulttest.Token, LeaseDuration: 1}}, nil
+}
+
+// TestTokenSourceRelogin switches tokens while certificates are being issued
+// with the same client, which the race detector checks.
+func TestTokenSourceRelogin(t *testing.T) {
+	server, client := newTestIssuer(t)
+	auth := &shortLivedToken{}
+	source := NewTokenSource(client.client, auth)
+	if err := source.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer source.Stop()
+	issuer := NewVaultIssuer(client.client, WithClientSource(source.Client))
+	rotater, _ := startTestRotater(t, issuer, WithTokenSource(source))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&auth.logins) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Only %d logins", atomic.LoadInt32(&auth.logins))
+		}
+		if err := rotater.refresh(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := source.Client().Auth().Token().LookupSelf(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if status := rotater.Status(); status.Token == nil || status.Token.State != StateHealthy {
+		t.Errorf("Token status is %+v, want healthy", status.Token)
+	}
+	if server.Requests(vaulttest.EndpointIssue) < 3 {
+		t.Error("Didn't issue while logging in")
+	}
+}
+
+// slowRelogin is a shortLivedToken whose logins after the first take a while,
+// and signal when they start, so that the TokenSource can be stopped while one
+// is in flight.
+type slowRelogin struct {
+	shortLivedToken
+	relogging chan struct{}
+}
+
+func (auth *slowRelogin) Login(client *vaultapi.Client) (*vaultapi.Secret, error) {
+	if atomic.LoadInt32(&auth.logins) > 0 {
+		select {
+		case auth.relogging <- struct{}{}:
+		default:
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return auth.shortLivedToken.Login(client)
+}
+
+func TestTokenSourceStop(t *testing.T) {
+	tests := []struct {
+		name string
+		auth Authenticator
+	}{
+		{"token that doesn't expire", StaticToken(vaulttest.Token)},
+		{"token logged in again", &shortLivedToken{}},
+		{"while logging in again", &slowRelogin{relogging: make(chan struct{})}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, issuer := newTestIssuer(t)
+			source := NewTokenSource(issuer.client, test.auth)
+			if err := source.Start(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if auth, ok := test.auth.(*slowRelogin); ok {
+				select {
+				case <-auth.relogging:
+				case <-time.After(5 * time.Second):
+					t.Fatal("Didn't log in again")
+				}
+			}
+			source.Stop()
+			if goroutineRunning("(*TokenSource).run") {
+				t.Error("Stop returned before the renewal stopped")
+			}
+			source.Stop()
+		})
+	}
+}
+
+// failingLogin is an Authenticator that can't log in.
+type failingLogin struct{}
+
+func (failingLogin) Login(client *vaultapi.Client) (*vaultapi.Secret, error) {
+	return nil, errors.New("permission denied")
+}
+
+func TestTokenSourceStartCancelled(t *testing.T) {
+	_, issuer := newTestIssuer(t)
+	source := NewTokenSource(issuer.client, failingLogin{})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	if err := source.Start(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Start returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("Start returned after %v", elapsed)
+	}
+	source.Stop()
+}
+
+func TestTokenSourceStoppedByContext(t *testing.T) {
+	_, issuer := newTestIssuer(t)
+	source := NewTokenSource(issuer.client, &shortLivedToken{})
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := source.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	checkNoGoroutine(t, "(*TokenSource).run")
+	source.Stop()
+}
+
+func TestLogin(t *testing.T) {
+	dir := t.TempDir()
+	credentials := filepath.Join(dir, "credentials")
+	if err := ioutil.WriteFile(credentials, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	wrapped := filepath.Join(dir, "wrapped")
+	if err := ioutil.WriteFile(wrapped, []byte("wrapping-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		auth    Authenticator
+		path    string
+		params  map[string]string
+		unwraps int32
+	}{
+		{"AppRole", &AppRole{RoleID: "role-id", SecretIDFile: credentials}, "/v1/auth/approle/login", map[string]string{"role_id": "role-id", "secret_id": "s3cret"}, 0},
+		{"AppRole at custom mount", &AppRole{Mount: "/sidecars/", RoleID: "role-id", SecretIDFile: credentials}, "/v1/auth/sidecars/login", map[string]string{"role_id": "role-id", "secret_id": "s3cret"}, 0},
+		{"AppRole with wrapped secret_id", &AppRole{RoleID: "role-id", SecretIDFile: wrapped, Wrapped: true}, "/v1/auth/approle/login", map[string]string{"role_id": "role-id", "secret_id": "unwrapped-s3cret"}, 1},
+		{"Kubernetes", &Kubernetes{Role: "dumbserver", TokenFile: credentials}, "/v1/auth/kubernetes/login", map[string]string{"role": "dumbserver", "jwt": "s3cret"}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var unwraps int32
+			vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/v1/sys/wrapping/unwrap" {
+					// Wrapping tokens can only be unwrapped once
+					if atomic.AddInt32(&unwraps, 1) > 1 {
+						http.Error(w, `{"errors":["wrapping token is not valid or does not exist"]}`, http.StatusBadRequest)
+						return
+					}
+					if token := r.Header.Get("X-Vault-Token"); token != "wrapping-token" {
+						t.Errorf("Unwrapped with token %q", token)
+					}
+					json.NewEncoder(w).Encode(map[string]interface{}{
+						"data": map[string]interface{}{"secret_id": "unwrapped-s3cret"},
+					})
+					return
+				}
+				if r.URL.Path != test.path {
+					http.NotFound(w, r)
+					return
+				}
+				if token := r.Header.Get("X-Vault-Token"); token != "" {
+					t.Errorf("Logged in with token %q", token)
+				}
+				var params map[string]string
+				if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+					t.Error(err)
+				}
+				for name, want := range test.params {
+					if params[name] != want {
+						t.Errorf("Parameter %v is %q, want %q", name, params[name], want)
+					}
+				}
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"auth": map[string]interface{}{"client_token": "new-token", "lease_duration": 60},
+				})
+			}))
+			defer vault.Close()
+			config := vaultapi.DefaultConfig()
+			config.Address = vault.URL
+			client, err := vaultapi.NewClient(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.SetToken("old-token")
+
+			// Log in again, as when the token can no longer be renewed
+			for i := 0; i < 2; i++ {
+				secret, err := test.auth.Login(client)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if secret.Auth == nil || secret.Auth.ClientToken != "new-token" {
+					t.Errorf("Login returned %+v, want new-token", secret.Auth)
+				}
+				if token := client.Token(); token != "old-token" {
+					t.Errorf("Login changed the token of the client to %q", token)
+				}
+			}
+			if unwraps := atomic.LoadInt32(&unwraps); unwraps != test.unwraps {
+				t.Errorf("Unwrapped %d times, want %d", unwraps, test.unwraps)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// trustStore holds the roots peers are verified against. Roots that disappear
+// from the trust bundle stay trusted for an overlap period after the first
+// update they are missing from, so that peers still presenting certificates
+// from an old root keep working while a CA is being rotated.
+type trustStore struct {
+	overlap time.Duration
+
+	mu    sync.Mutex
+	roots map[[sha256.Size]byte]*trustedRoot
+	pool  atomic.Pointer[x509.CertPool]
+}
+
+type trustedRoot struct {
+	certificate *x509.Certificate
+	// missingSince is when the root was first missing from the trust bundle,
+	// or zero while it is in it.
+	missingSince time.Time
+}
+
+func newTrustStore(overlap time.Duration) *trustStore {
+	return &trustStore{
+		overlap: overlap,
+		roots:   make(map[[sha256.Size]byte]*trustedRoot),
+	}
+}
+
+// update merges a PEM encoded trust bundle into the store and rebuilds the
+// pool from the roots in the bundle and those missing from it for less than
+// the overlap period, leaving out expired ones.
+func (store *trustStore) update(bundle []byte) error {
+	var certificates []*x509.Certificate
+	for block, rest := pem.Decode(bundle); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("Couldn't parse trust bundle: %v", err)
+		}
+		certificates = append(certificates, certificate)
+	}
+	if len(certificates) == 0 {
+		return fmt.Errorf("Error loading CA chain")
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	now := time.Now()
+	present := make(map[[sha256.Size]byte]bool, len(certificates))
+	for _, certificate := range certificates {
+		fingerprint := sha256.Sum256(certificate.Raw)
+		present[fingerprint] = true
+		store.roots[fingerprint] = &trustedRoot{certificate: certificate}
+	}
+	pool := x509.NewCertPool()
+	for fingerprint, root := range store.roots {
+		if !present[fingerprint] && root.missingSince.IsZero() {
+			root.missingSince = now
+		}
+		if !root.missingSince.IsZero() && now.Sub(root.missingSince) >= store.overlap {
+			delete(store.roots, fingerprint)
+			continue
+		}
+		if now.After(root.certificate.NotAfter) {
+			delete(store.roots, fingerprint)
+			continue
+		}
+		pool.AddCert(root.certificate)
+	}
+	store.pool.Store(pool)
+	return nil
+}
+
+// refreshTrust fetches the trust bundle from the Issuer and merges it into
+// the trust store.
+func (rotater *TLSRotater) refreshTrust() error {
+	trustBundle, err := rotater.issuer.TrustBundle()
+	if err != nil {
+		return &refreshError{reason: ReasonTrustBundle, err: fmt.Errorf("Couldn't fetch trust bundle: %v", err)}
+	}
+	if err := rotater.trust.update(trustBundle); err != nil {
+		return &refreshError{reason: ReasonTrustBundle, err: err}
+	}
+	return nil
+}
+
+// Pool returns the current pool of trusted roots.
+func (store *trustStore) Pool() *x509.CertPool {
+	return store.pool.Load()
+}
+
+// certificates returns the current roots.
+func (store *trustStore) certificates() []*x509.Certificate {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	certificates := make([]*x509.Certificate, 0, len(store.roots))
+	for _, root := range store.roots {
+		certificates = append(certificates, root.certificate)
+	}
+	return certificates
+}
+
+// PEM returns the current roots PEM encoded, ordered by fingerprint.
+func (store *trustStore) PEM() []byte {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	fingerprints := make([][sha256.Size]byte, 0, len(store.roots))
+	for fingerprint := range store.roots {
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	sort.Slice(fingerprints, func(i, j int) bool {
+		return bytes.Compare(fingerprints[i][:], fingerprints[j][:]) < 0
+	})
+	var bundle []byte
+	for _, fingerprint := range fingerprints {
+		bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: store.roots[fingerprint].certificate.Raw})...)
+	}
+	return bundle
+}
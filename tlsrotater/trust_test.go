@@ -0,0 +1,128 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/sirlatrom/tls-sidecar-playground/tlsrotater/vaulttest"
+)
+
+func TestCARotation(t *testing.T) {
+	tests := []struct {
+		name           string
+		overlap        time.Duration
+		oldRootTrusted bool
+	}{
+		{"within overlap", 24 * time.Hour, true},
+		{"without overlap", 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, issuer := newTestIssuer(t)
+			rotater, events := startTestRotater(t, issuer, WithTrustOverlap(test.overlap))
+			oldLeaf := nextEvent(t, events, EventRotated).Certificate.Keypair.Leaf
+			oldCA := server.CA()
+
+			if err := server.RotateCA(); err != nil {
+				t.Fatal(err)
+			}
+			if err := rotater.refresh(); err != nil {
+				t.Fatal(err)
+			}
+			newLeaf := nextEvent(t, events, EventRotated).Certificate.Keypair.Leaf
+			if err := newLeaf.CheckSignatureFrom(server.CA()); err != nil {
+				t.Fatalf("New certificate isn't issued by the new CA: %v", err)
+			}
+			if err := verifyLeaf(rotater, newLeaf); err != nil {
+				t.Errorf("New certificate isn't trusted: %v", err)
+			}
+			if err := verifyLeaf(rotater, oldLeaf); (err == nil) != test.oldRootTrusted {
+				t.Errorf("Certificate of the old CA %v trusted: %v, want %v", oldCA.Subject.CommonName, err == nil, test.oldRootTrusted)
+			}
+		})
+	}
+}
+
+func TestTrustRefresh(t *testing.T) {
+	server, issuer := newTestIssuer(t)
+	rotater, _ := startTestRotater(t, issuer, WithTrustRefreshInterval(10*time.Millisecond))
+	if err := server.RotateCA(); err != nil {
+		t.Fatal(err)
+	}
+	peer, err := issuer.Issue(CertificateRequest{CommonName: "peer", TTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for verifyLeaf(rotater, peer.Keypair.Leaf) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("New CA wasn't trusted without renewing")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := server.Requests(vaulttest.EndpointIssue); got != 2 {
+		t.Errorf("%d issue requests, want only the first certificate and the peer's", got)
+	}
+}
+
+func TestTrustOverlap(t *testing.T) {
+	oldCA, newCA := vaulttest.NewServer(), vaulttest.NewServer()
+	oldCA.Close()
+	newCA.Close()
+	oldPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: oldCA.CA().Raw})
+	newPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: newCA.CA().Raw})
+	trusted := func(store *trustStore) bool {
+		for _, certificate := range store.certificates() {
+			if certificate.Equal(oldCA.CA()) {
+				return true
+			}
+		}
+		return false
+	}
+
+	store := newTrustStore(time.Hour)
+	if err := store.update(oldPEM); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.update(newPEM); err != nil {
+		t.Fatal(err)
+	}
+	if !trusted(store) {
+		t.Fatal("Old root dropped as soon as it went missing")
+	}
+	if err := store.update(newPEM); err != nil {
+		t.Fatal(err)
+	}
+	if !trusted(store) {
+		t.Fatal("Old root dropped within the overlap")
+	}
+	for _, root := range store.roots {
+		if !root.missingSince.IsZero() {
+			root.missingSince = root.missingSince.Add(-time.Hour)
+		}
+	}
+	if err := store.update(newPEM); err != nil {
+		t.Fatal(err)
+	}
+	if trusted(store) {
+		t.Fatal("Old root trusted after the overlap")
+	}
+}
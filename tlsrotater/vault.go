@@ -0,0 +1,285 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+package tlsrotater
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// VaultIssuer is an Issuer backed by a Vault PKI mount.
+type VaultIssuer struct {
+	client       *vaultapi.Client
+	clientSource func() *vaultapi.Client
+	mount        string
+	role         string
+}
+
+// VaultOption configures a VaultIssuer.
+type VaultOption func(*VaultIssuer)
+
+// WithMount sets the path of the PKI mount. Defaults to "pki".
+func WithMount(mount string) VaultOption {
+	return func(issuer *VaultIssuer) {
+		issuer.mount = strings.Trim(mount, "/")
+	}
+}
+
+// WithRole sets the PKI role certificates are issued under. Defaults to the
+// common name of each request.
+func WithRole(role string) VaultOption {
+	return func(issuer *VaultIssuer) {
+		issuer.role = role
+	}
+}
+
+// WithClientSource makes the issuer get the client for every request from the
+// given function, such as TokenSource.Client, rather than using the client it
+// was created with.
+func WithClientSource(source func() *vaultapi.Client) VaultOption {
+	return func(issuer *VaultIssuer) {
+		issuer.clientSource = source
+	}
+}
+
+// NewVaultIssuer creates an Issuer using a Vault PKI mount.
+func NewVaultIssuer(client *vaultapi.Client, options ...VaultOption) *VaultIssuer {
+	issuer := &VaultIssuer{
+		client: client,
+		mount:  "pki",
+	}
+	for _, option := range options {
+		option(issuer)
+	}
+	return issuer
+}
+
+// vault returns the client to make a request with.
+func (issuer *VaultIssuer) vault() *vaultapi.Client {
+	if issuer.clientSource != nil {
+		return issuer.clientSource()
+	}
+	return issuer.client
+}
+
+// Issue implements Issuer. If the request carries a private key, a CSR for it
+// is sent to the sign endpoint of the role, so that the key never leaves the
+// process. Otherwise Vault generates the key through the issue endpoint.
+func (issuer *VaultIssuer) Issue(request CertificateRequest) (*Certificate, error) {
+	role := issuer.role
+	if role == "" {
+		role = request.CommonName
+	}
+	params := make(map[string]interface{})
+	params["common_name"] = request.CommonName
+	if len(request.DNSNames) > 0 {
+		params["alt_names"] = strings.Join(request.DNSNames, ",")
+	}
+	if len(request.IPAddresses) > 0 {
+		var ipSANs []string
+		for _, ip := range request.IPAddresses {
+			ipSANs = append(ipSANs, ip.String())
+		}
+		params["ip_sans"] = strings.Join(ipSANs, ",")
+	}
+	if len(request.URIs) > 0 {
+		var uriSANs []string
+		for _, uri := range request.URIs {
+			uriSANs = append(uriSANs, uri.String())
+		}
+		params["uri_sans"] = strings.Join(uriSANs, ",")
+	}
+	if request.TTL > 0 {
+		params["ttl"] = request.TTL.String()
+	}
+	params["exclude_cn_from_sans"] = request.ExcludeCNFromSANs
+	path := issuer.mount + "/issue/" + role
+	if request.Key != nil {
+		csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			Subject:     pkix.Name{CommonName: request.CommonName},
+			DNSNames:    request.DNSNames,
+			IPAddresses: request.IPAddresses,
+			URIs:        request.URIs,
+		}, request.Key)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't create CSR: %v", err)
+		}
+		params["csr"] = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr}))
+		path = issuer.mount + "/sign/" + role
+	}
+	secret, err := issuer.vault().Logical().Write(path, params)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("No certificate returned from %v", path)
+	}
+
+	// Extract the data
+	certificate, ok := secret.Data["certificate"].(string)
+	if !ok {
+		return nil, fmt.Errorf("No certificate returned from %v", path)
+	}
+	serial, ok := secret.Data["serial_number"].(string)
+	if !ok {
+		return nil, fmt.Errorf("No serial number returned from %v", path)
+	}
+	certificateContents := []byte(certificate)
+	var keypair tls.Certificate
+	if request.Key != nil {
+		keypair, err = signedKeypair(certificateContents, request.Key)
+	} else {
+		privateKey, ok := secret.Data["private_key"].(string)
+		if !ok {
+			return nil, fmt.Errorf("No private key returned from %v", path)
+		}
+		keypair, err = tls.X509KeyPair(certificateContents, []byte(privateKey))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't load cert: %v", err)
+	}
+	var caChainContents []byte
+	if caChain, ok := secret.Data["ca_chain"].([]interface{}); ok && len(caChain) > 0 {
+		var chain []string
+		for _, ca := range caChain {
+			caPEM, ok := ca.(string)
+			if !ok {
+				return nil, fmt.Errorf("Unexpected CA chain returned from %v", path)
+			}
+			chain = append(chain, caPEM)
+		}
+		caChainContents = []byte(strings.Join(chain, "\n"))
+	} else if issuingCA, ok := secret.Data["issuing_ca"].(string); ok {
+		caChainContents = []byte(issuingCA)
+	} else {
+		return nil, fmt.Errorf("No issuing CA returned from %v", path)
+	}
+	return &Certificate{
+		Keypair: &keypair,
+		Serial:  serial,
+		CAChain: caChainContents,
+	}, nil
+}
+
+// signedKeypair pairs a PEM encoded certificate signed from a CSR with the
+// private key the CSR was made for.
+func signedKeypair(certificateContents []byte, key crypto.Signer) (tls.Certificate, error) {
+	var keypair tls.Certificate
+	for block, rest := pem.Decode(certificateContents); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			keypair.Certificate = append(keypair.Certificate, block.Bytes)
+		}
+	}
+	if len(keypair.Certificate) == 0 {
+		return keypair, fmt.Errorf("No certificate found")
+	}
+	leaf, err := x509.ParseCertificate(keypair.Certificate[0])
+	if err != nil {
+		return keypair, err
+	}
+	publicKey, ok := leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !publicKey.Equal(key.Public()) {
+		return keypair, fmt.Errorf("Signed certificate doesn't match the private key")
+	}
+	keypair.PrivateKey = key
+	keypair.Leaf = leaf
+	return keypair, nil
+}
+
+// Revoke implements Issuer. Tidying the PKI mount is left to a VaultTidier.
+func (issuer *VaultIssuer) Revoke(serial string) error {
+	revokeParams := make(map[string]interface{})
+	revokeParams["serial_number"] = serial
+	secret, err := issuer.vault().Logical().Write(issuer.mount+"/revoke", revokeParams)
+	if err != nil {
+		return err
+	}
+	if secret == nil {
+		return fmt.Errorf("No revocation returned from %v/revoke", issuer.mount)
+	}
+	revocationTime, ok := secret.Data["revocation_time"].(json.Number)
+	if !ok {
+		return fmt.Errorf("No revocation time returned from %v/revoke", issuer.mount)
+	}
+	revocationTimeNumber, err := revocationTime.Int64()
+	if err != nil {
+		return fmt.Errorf("Couldn't parse revocation time number: %v", err)
+	}
+	log.Printf("Old certificate revoked at %v\n", time.Unix(revocationTimeNumber, 0))
+	return nil
+}
+
+// OCSP implements OCSPResponder through the OCSP endpoint of the PKI mount.
+func (issuer *VaultIssuer) OCSP(request []byte) ([]byte, error) {
+	client := issuer.vault()
+	r := client.NewRequest("POST", "/v1/"+issuer.mount+"/ocsp")
+	r.Headers = http.Header{"Content-Type": []string{"application/ocsp-request"}}
+	r.Body = bytes.NewReader(request)
+	r.BodySize = int64(len(request))
+	response, err := client.RawRequest(r)
+	if response != nil {
+		defer response.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(response.Body)
+}
+
+// CRL implements CRLSource by reading the CRL of the PKI mount.
+func (issuer *VaultIssuer) CRL() ([]byte, error) {
+	client := issuer.vault()
+	response, err := client.RawRequest(client.NewRequest("GET", "/v1/"+issuer.mount+"/crl"))
+	if response != nil {
+		defer response.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(response.Body)
+}
+
+// TrustBundle implements Issuer by reading the CA certificate of the PKI mount.
+func (issuer *VaultIssuer) TrustBundle() ([]byte, error) {
+	secret, err := issuer.vault().Logical().Read(issuer.mount + "/cert/ca")
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("No CA certificate found at %v/cert/ca", issuer.mount)
+	}
+	certificate, ok := secret.Data["certificate"].(string)
+	if !ok {
+		return nil, fmt.Errorf("Unexpected CA certificate response from %v/cert/ca", issuer.mount)
+	}
+	return []byte(certificate), nil
+}
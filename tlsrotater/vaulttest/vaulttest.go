@@ -0,0 +1,606 @@
+/*
+Copyright (C) 2017 Sune Keller <absukl@almbrand.dk> 
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+*/
+// Package vaulttest provides an in-memory fake of a Vault PKI mount for
+// testing code that issues certificates through Vault, without a real Vault.
+//
+// The Server backs the endpoints used by the tlsrotater package with a real
+// CA kept in memory, and lets tests inject faults into each of them:
+//  server := vaulttest.NewServer()
+//  defer server.Close()
+//  client, err := server.Client()
+//  if err != nil {
+//  	t.Fatal(err)
+//  }
+//  server.Inject(vaulttest.EndpointIssue, vaulttest.Fault{Status: http.StatusServiceUnavailable, Count: 2})
+//  issuer := tlsrotater.NewVaultIssuer(client)
+package vaulttest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"golang.org/x/crypto/ocsp"
+)
+
+// Endpoints of the PKI mount that faults can be injected into.
+const (
+	EndpointIssue  = "issue"
+	EndpointSign   = "sign"
+	EndpointRevoke = "revoke"
+	EndpointTidy   = "tidy"
+	EndpointCA     = "ca"
+	EndpointCRL    = "crl"
+	EndpointOCSP   = "ocsp"
+)
+
+// Token is the token the Server accepts.
+const Token = "vaulttest-token"
+
+// defaultTTL is the lifetime of certificates issued without a ttl.
+const defaultTTL = time.Hour
+
+// Fault is a failure injected into an endpoint.
+type Fault struct {
+	// Latency delays the response.
+	Latency time.Duration
+	// Status makes the endpoint fail with the given HTTP status.
+	Status int
+	// Malformed makes the endpoint respond with a body that can't be parsed.
+	Malformed bool
+	// Count is how many requests the fault applies to. Zero means all of
+	// them until the fault is cleared.
+	Count int
+}
+
+// Server is a fake Vault serving a PKI mount from an in-memory CA.
+type Server struct {
+	// URL is the address of the server, such as http://127.0.0.1:1234.
+	URL string
+	// Mount is the path of the PKI mount. Defaults to "pki".
+	Mount string
+
+	server *httptest.Server
+
+	mu       sync.Mutex
+	caKey    crypto.Signer
+	ca       *x509.Certificate
+	caPEM    []byte
+	serial   int64
+	issued   map[string]*x509.Certificate
+	revoked  map[string]time.Time
+	faults   map[string]*Fault
+	requests map[string]int
+}
+
+// NewServer starts a Server with a freshly generated CA.
+func NewServer() *Server {
+	server := &Server{
+		Mount:    "pki",
+		issued:   make(map[string]*x509.Certificate),
+		revoked:  make(map[string]time.Time),
+		faults:   make(map[string]*Fault),
+		requests: make(map[string]int),
+	}
+	if err := server.RotateCA(); err != nil {
+		panic(fmt.Sprintf("vaulttest: couldn't create CA: %v", err))
+	}
+	server.server = httptest.NewServer(http.HandlerFunc(server.handle))
+	server.URL = server.server.URL
+	return server
+}
+
+// Close shuts the server down.
+func (server *Server) Close() {
+	server.server.Close()
+}
+
+// Client returns a Vault client for the server, logged in with Token.
+func (server *Server) Client() (*vaultapi.Client, error) {
+	config := vaultapi.DefaultConfig()
+	config.Address = server.URL
+	config.MaxRetries = 0
+	client, err := vaultapi.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	client.SetToken(Token)
+	return client, nil
+}
+
+// RotateCA replaces the CA with a freshly generated one. Certificates issued
+// by the previous CA are forgotten.
+func (server *Server) RotateCA() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: fmt.Sprintf("vaulttest CA %x", serialNumber)},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return err
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.caKey = key
+	server.ca = ca
+	server.caPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	server.issued = make(map[string]*x509.Certificate)
+	server.revoked = make(map[string]time.Time)
+	return nil
+}
+
+// CA returns the current CA certificate.
+func (server *Server) CA() *x509.Certificate {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.ca
+}
+
+// Inject makes the given endpoint fail with the fault, replacing any fault
+// injected into it before.
+func (server *Server) Inject(endpoint string, fault Fault) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.faults[endpoint] = &fault
+}
+
+// ClearFaults removes all injected faults.
+func (server *Server) ClearFaults() {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.faults = make(map[string]*Fault)
+}
+
+// Requests returns how many requests the given endpoint has received,
+// including failed ones.
+func (server *Server) Requests(endpoint string) int {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.requests[endpoint]
+}
+
+// Issued returns the certificates issued by the current CA, by serial number.
+func (server *Server) Issued() map[string]*x509.Certificate {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	issued := make(map[string]*x509.Certificate, len(server.issued))
+	for serial, certificate := range server.issued {
+		issued[serial] = certificate
+	}
+	return issued
+}
+
+// Revoked reports whether the certificate with the given serial number has
+// been revoked.
+func (server *Server) Revoked(serial string) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	_, revoked := server.revoked[serial]
+	return revoked
+}
+
+// handle routes a request to the endpoint it is for, applying any fault
+// injected into that endpoint.
+func (server *Server) handle(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+	if path == "auth/token/lookup-self" {
+		server.lookupSelf(w, r)
+		return
+	}
+	if !strings.HasPrefix(path, server.Mount+"/") {
+		writeError(w, http.StatusNotFound, "no handler for route %q", path)
+		return
+	}
+	path = strings.TrimPrefix(path, server.Mount+"/")
+	var endpoint string
+	var handler func(http.ResponseWriter, *http.Request, string)
+	switch {
+	case strings.HasPrefix(path, "issue/"):
+		endpoint, handler = EndpointIssue, server.issue
+	case strings.HasPrefix(path, "sign/"):
+		endpoint, handler = EndpointSign, server.sign
+	case path == "revoke":
+		endpoint, handler = EndpointRevoke, server.revoke
+	case path == "tidy":
+		endpoint, handler = EndpointTidy, server.tidy
+	case path == "ca/pem" || path == "cert/ca":
+		endpoint, handler = EndpointCA, server.caCertificate
+	case path == "crl":
+		endpoint, handler = EndpointCRL, server.crl
+	case path == "ocsp":
+		endpoint, handler = EndpointOCSP, server.ocsp
+	default:
+		writeError(w, http.StatusNotFound, "no handler for route %q", r.URL.Path)
+		return
+	}
+	if endpoint != EndpointCA && endpoint != EndpointCRL && endpoint != EndpointOCSP && r.Header.Get("X-Vault-Token") != Token {
+		writeError(w, http.StatusForbidden, "permission denied")
+		return
+	}
+	fault := server.fault(endpoint)
+	if fault.Latency > 0 {
+		time.Sleep(fault.Latency)
+	}
+	if fault.Status != 0 {
+		writeError(w, fault.Status, "injected fault")
+		return
+	}
+	if fault.Malformed {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data": {"certificate": `))
+		return
+	}
+	handler(w, r, path)
+}
+
+// fault counts a request to the endpoint and returns the fault to apply to
+// it, if any.
+func (server *Server) fault(endpoint string) Fault {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.requests[endpoint]++
+	fault, ok := server.faults[endpoint]
+	if !ok {
+		return Fault{}
+	}
+	if fault.Count > 0 {
+		fault.Count--
+		if fault.Count == 0 {
+			delete(server.faults, endpoint)
+		}
+	}
+	return *fault
+}
+
+// issue generates a key and issues a certificate for it.
+func (server *Server) issue(w http.ResponseWriter, r *http.Request, path string) {
+	params, err := readParams(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	data, err := server.certify(params, key.Public())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	data["private_key"] = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	data["private_key_type"] = "ec"
+	writeData(w, data)
+}
+
+// sign issues a certificate for the key of a CSR.
+func (server *Server) sign(w http.ResponseWriter, r *http.Request, path string) {
+	params, err := readParams(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	block, _ := pem.Decode([]byte(stringParam(params, "csr")))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		writeError(w, http.StatusBadRequest, "no CSR given")
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "couldn't parse CSR: %v", err)
+		return
+	}
+	if err := csr.CheckSignature(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid CSR signature: %v", err)
+		return
+	}
+	data, err := server.certify(params, csr.PublicKey)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	writeData(w, data)
+}
+
+// certify issues a certificate for a public key as described by the issue
+// and sign parameters.
+func (server *Server) certify(params map[string]interface{}, publicKey crypto.PublicKey) (map[string]interface{}, error) {
+	commonName := stringParam(params, "common_name")
+	if commonName == "" {
+		return nil, fmt.Errorf("the common_name field is required")
+	}
+	ttl := defaultTTL
+	if v := stringParam(params, "ttl"); v != "" {
+		var err error
+		if ttl, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("invalid ttl %q: %v", v, err)
+		}
+	}
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: commonName},
+		NotBefore:   time.Now().Add(-30 * time.Second),
+		NotAfter:    time.Now().Add(ttl),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageKeyAgreement,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if exclude, _ := params["exclude_cn_from_sans"].(bool); !exclude {
+		template.DNSNames = append(template.DNSNames, commonName)
+	}
+	template.DNSNames = append(template.DNSNames, splitParam(params, "alt_names")...)
+	for _, v := range splitParam(params, "ip_sans") {
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP SAN %q", v)
+		}
+		template.IPAddresses = append(template.IPAddresses, ip)
+	}
+	for _, v := range splitParam(params, "uri_sans") {
+		uri, err := url.Parse(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid URI SAN %q: %v", v, err)
+		}
+		template.URIs = append(template.URIs, uri)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.serial++
+	template.SerialNumber = big.NewInt(server.serial)
+	der, err := x509.CreateCertificate(rand.Reader, template, server.ca, publicKey, server.caKey)
+	if err != nil {
+		return nil, err
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	serial := formatSerial(certificate.SerialNumber)
+	server.issued[serial] = certificate
+	return map[string]interface{}{
+		"certificate":   string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		"issuing_ca":    string(server.caPEM),
+		"ca_chain":      []string{string(server.caPEM)},
+		"serial_number": serial,
+		"expiration":    certificate.NotAfter.Unix(),
+	}, nil
+}
+
+// revoke revokes a certificate issued by the current CA.
+func (server *Server) revoke(w http.ResponseWriter, r *http.Request, path string) {
+	params, err := readParams(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	serial := stringParam(params, "serial_number")
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if _, ok := server.issued[serial]; !ok {
+		writeError(w, http.StatusBadRequest, "certificate with serial %s not found", serial)
+		return
+	}
+	revoked, ok := server.revoked[serial]
+	if !ok {
+		revoked = time.Now()
+		server.revoked[serial] = revoked
+	}
+	writeData(w, map[string]interface{}{"revocation_time": revoked.Unix()})
+}
+
+// tidy forgets expired certificates.
+func (server *Server) tidy(w http.ResponseWriter, r *http.Request, path string) {
+	server.mu.Lock()
+	now := time.Now()
+	for serial, certificate := range server.issued {
+		if now.After(certificate.NotAfter) {
+			delete(server.issued, serial)
+			delete(server.revoked, serial)
+		}
+	}
+	server.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"warnings": []string{"Tidy operation successfully started."},
+	})
+}
+
+// caCertificate returns the CA certificate, as PEM from ca/pem and wrapped in
+// JSON from cert/ca.
+func (server *Server) caCertificate(w http.ResponseWriter, r *http.Request, path string) {
+	server.mu.Lock()
+	caPEM := server.caPEM
+	server.mu.Unlock()
+	if path == "ca/pem" {
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(caPEM)
+		return
+	}
+	writeData(w, map[string]interface{}{"certificate": string(caPEM)})
+}
+
+// crl returns the DER encoded CRL of the current CA.
+func (server *Server) crl(w http.ResponseWriter, r *http.Request, path string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	list := &x509.RevocationList{
+		Number:     big.NewInt(time.Now().UnixNano()),
+		ThisUpdate: time.Now(),
+		NextUpdate: time.Now().Add(72 * time.Hour),
+	}
+	for serial, revoked := range server.revoked {
+		list.RevokedCertificateEntries = append(list.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   server.issued[serial].SerialNumber,
+			RevocationTime: revoked,
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, list, server.ca, server.caKey)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	w.Write(der)
+}
+
+// ocsp answers an OCSP request for a certificate issued by the current CA.
+func (server *Server) ocsp(w http.ResponseWriter, r *http.Request, path string) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	request, err := ocsp.ParseRequest(body)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(ocsp.MalformedRequestErrorResponse)
+		return
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	serial := formatSerial(request.SerialNumber)
+	template := ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: request.SerialNumber,
+		ThisUpdate:   time.Now(),
+		NextUpdate:   time.Now().Add(12 * time.Hour),
+	}
+	if _, ok := server.issued[serial]; !ok {
+		template.Status = ocsp.Unknown
+	}
+	if revoked, ok := server.revoked[serial]; ok {
+		template.Status = ocsp.Revoked
+		template.RevokedAt = revoked
+	}
+	response, err := ocsp.CreateResponse(server.ca, server.ca, template, server.caKey)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(response)
+}
+
+// lookupSelf describes Token as a non-renewable token that doesn't expire.
+func (server *Server) lookupSelf(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Vault-Token") != Token {
+		writeError(w, http.StatusForbidden, "permission denied")
+		return
+	}
+	writeData(w, map[string]interface{}{
+		"id":        Token,
+		"ttl":       0,
+		"renewable": false,
+		"policies":  []string{"root"},
+	})
+}
+
+// readParams decodes the JSON body of a request.
+func readParams(r *http.Request) (map[string]interface{}, error) {
+	params := make(map[string]interface{})
+	if r.ContentLength == 0 {
+		return params, nil
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		return nil, fmt.Errorf("couldn't parse request body: %v", err)
+	}
+	return params, nil
+}
+
+// stringParam returns a string parameter, or "" if it isn't set.
+func stringParam(params map[string]interface{}, name string) string {
+	v, _ := params[name].(string)
+	return v
+}
+
+// splitParam returns a comma separated parameter as a list.
+func splitParam(params map[string]interface{}, name string) []string {
+	var values []string
+	for _, v := range strings.Split(stringParam(params, name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// formatSerial formats a serial number the way Vault does, as colon separated
+// hex bytes.
+func formatSerial(serial *big.Int) string {
+	digits := hex.EncodeToString(serial.Bytes())
+	var bytes []string
+	for i := 0; i < len(digits); i += 2 {
+		bytes = append(bytes, digits[i:i+2])
+	}
+	return strings.Join(bytes, ":")
+}
+
+// writeData writes a Vault response with the given data.
+func writeData(w http.ResponseWriter, data map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+}
+
+// writeError writes a Vault error response.
+func writeError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors": []string{fmt.Sprintf(format, args...)},
+	})
+}